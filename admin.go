@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// AdminHandler returns an http.Handler to inspect and manage the cache,
+// typically mounted on a debug port:
+//
+//	http.Handle("/debug/dns/", http.StripPrefix("/debug/dns", cache.AdminHandler()))
+//
+// The handler serves these routes:
+//
+//	GET  /       Stats and the cache entries as JSON, including the question,
+//	             IPs, remaining TTL, and hit count of each entry.
+//	POST /purge  Removes entries and responds with the number removed as JSON.
+//	             Use one of the query parameters:
+//	               name=example.com         the entries for the name of all
+//	                                        types and namespaces, or only
+//	                                        those matching the optional type
+//	                                        and namespace parameters
+//	               suffix=example.com       the entries for the name and
+//	                                        subdomains
+//	               all=true                 all entries
+//
+// Listing entries requires an IterableQuestionCache. Otherwise, the entries
+// are omitted. Hit counts are only tracked by the default, in-memory cache.
+// Purging requires a PurgeableQuestionCache. Otherwise, purging responds with
+// 501 Not Implemented.
+func (c *Cache) AdminHandler() http.Handler {
+	c.init()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", c.serveAdminEntries)
+	mux.HandleFunc("POST /purge", c.serveAdminPurge)
+	return mux
+}
+
+// adminEntry is the JSON representation of a cache entry.
+type adminEntry struct {
+	Question  string       `json:"question"`
+	Type      string       `json:"type"`
+	Class     string       `json:"class"`
+	Namespace string       `json:"namespace,omitempty"`
+	RCode     string       `json:"rcode"`
+	CNAMEs    []string     `json:"cnames,omitempty"`
+	IPs       []netip.Addr `json:"ips,omitempty"`
+	// Records is the number of records other than A, AAAA, and CNAME.
+	Records int `json:"records,omitempty"`
+	// RemainingTTLSeconds is negative for expired answers retained to serve
+	// stale.
+	RemainingTTLSeconds float64 `json:"remaining_ttl_seconds"`
+	Hits                int64   `json:"hits"`
+}
+
+func (c *Cache) serveAdminEntries(w http.ResponseWriter, _ *http.Request) {
+	resp := struct {
+		Stats   Stats        `json:"stats"`
+		Entries []adminEntry `json:"entries"`
+	}{Stats: c.Stats()}
+	var entries []questionEntry
+	switch qc := c.QuestionCache.(type) {
+	case *questionCache:
+		entries = qc.entries()
+	case IterableQuestionCache:
+		entries = []questionEntry{}
+		for q, a := range qc.All() {
+			entries = append(entries, questionEntry{q: q, a: a})
+		}
+	}
+	if entries != nil {
+		resp.Entries = []adminEntry{}
+		for _, e := range entries {
+			ae := adminEntry{
+				Question:            e.q.FQDN,
+				Type:                TypeLabel(e.q.Type),
+				Class:               e.q.Class.String(),
+				Namespace:           e.q.Namespace,
+				RCode:               e.a.RCode.String(),
+				IPs:                 e.a.IPs,
+				Records:             len(e.a.Records),
+				RemainingTTLSeconds: e.a.RemainingTTL().Seconds(),
+				Hits:                e.hits,
+			}
+			for _, cname := range e.a.CNAMEs {
+				ae.CNAMEs = append(ae.CNAMEs, cname.Target)
+			}
+			resp.Entries = append(resp.Entries, ae)
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+func (c *Cache) serveAdminPurge(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var purged int
+	var err error
+	switch {
+	case params.Has("name"):
+		var typ dnsmessage.Type
+		if params.Has("type") {
+			var typeErr error
+			if typ, typeErr = parseTypeLabel(params.Get("type")); typeErr != nil {
+				writeAdminError(w, http.StatusBadRequest, typeErr.Error())
+				return
+			}
+		}
+		fqdn, namespace := canonicalFQDN(params.Get("name")), params.Get("namespace")
+		if params.Has("type") && params.Has("namespace") {
+			var ok bool
+			ok, err = c.Delete(Question{FQDN: fqdn, Type: typ, Namespace: namespace})
+			if ok {
+				purged = 1
+			}
+			break
+		}
+		purged, err = c.deleteFunc(func(q Question) bool {
+			return q.FQDN == fqdn &&
+				(!params.Has("type") || q.Type == typ) &&
+				(!params.Has("namespace") || q.Namespace == namespace)
+		})
+	case params.Has("suffix"):
+		purged, err = c.PurgeSuffix(params.Get("suffix"))
+	case params.Get("all") == "true":
+		purged, err = c.Purge()
+	default:
+		writeAdminError(w, http.StatusBadRequest, "purge requires a name, suffix, or all=true query parameter")
+		return
+	}
+	if errors.Is(err, ErrPurgeUnsupported) {
+		writeAdminError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, struct {
+		Purged int `json:"purged"`
+	}{purged})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// labelledTypes returns the question types with a mnemonic from TypeLabel.
+func labelledTypes() []dnsmessage.Type {
+	return []dnsmessage.Type{
+		dnsmessage.TypeA,
+		dnsmessage.TypeNS,
+		dnsmessage.TypeCNAME,
+		dnsmessage.TypeSOA,
+		dnsmessage.TypePTR,
+		dnsmessage.TypeMX,
+		dnsmessage.TypeTXT,
+		dnsmessage.TypeAAAA,
+		dnsmessage.TypeSRV,
+		dnsmessage.TypeOPT,
+		dnsmessage.TypeWKS,
+		dnsmessage.TypeHINFO,
+		dnsmessage.TypeMINFO,
+		dnsmessage.TypeAXFR,
+		dnsmessage.TypeALL,
+		typeSVCB,
+		typeHTTPS,
+	}
+}
+
+// parseTypeLabel returns the question type for a label from TypeLabel, like
+// "AAAA" or "TYPE65534". Case-insensitive.
+func parseTypeLabel(label string) (dnsmessage.Type, error) {
+	for _, typ := range labelledTypes() {
+		if strings.EqualFold(label, TypeLabel(typ)) {
+			return typ, nil
+		}
+	}
+	if n, ok := strings.CutPrefix(strings.ToUpper(label), "TYPE"); ok {
+		if v, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return dnsmessage.Type(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown dns type %q", label)
+}
@@ -0,0 +1,112 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCache_AdminHandler(t *testing.T) {
+	cache := &Cache{}
+	cache.init()
+	ip := netip.MustParseAddr("10.0.0.1")
+	for _, q := range []Question{
+		{FQDN: "example.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		{FQDN: "example.com.", Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+		{FQDN: "example.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, Namespace: "192.0.2.53:53"},
+		{FQDN: "example.com.", Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, Namespace: "192.0.2.53:53"},
+		{FQDN: "www.example.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		{FQDN: "api.example.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		{FQDN: "example.org.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+	} {
+		cache.QuestionCache.Set(q, Answer{FetchTime: time.Now(), TTL: time.Minute, IPs: []netip.Addr{ip}})
+	}
+	cache.QuestionCache.Get(Question{FQDN: "example.org.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	handler := cache.AdminHandler()
+
+	var list struct {
+		Stats   Stats        `json:"stats"`
+		Entries []adminEntry `json:"entries"`
+	}
+	serveAdmin(t, handler, http.MethodGet, "/", http.StatusOK, &list)
+	if list.Stats.Entries != 7 || len(list.Entries) != 7 {
+		t.Fatalf("want 7 entries; got stats %+v and entries %+v", list.Stats, list.Entries)
+	}
+	// Entries are ordered from most to least recently used.
+	got := list.Entries[0]
+	if got.Question != "example.org." || got.Type != "A" || got.Hits != 1 || !slices.Equal(got.IPs, []netip.Addr{ip}) ||
+		got.RemainingTTLSeconds <= 0 || got.RemainingTTLSeconds > 60 {
+		t.Errorf("unexpected first entry: %+v", got)
+	}
+
+	purges := []struct {
+		query      string
+		wantStatus int
+		wantPurged int
+	}{
+		{query: "name=Example.com&type=aaaa&namespace=192.0.2.53:53", wantStatus: http.StatusOK, wantPurged: 1},
+		{query: "name=example.com&type=aaaa", wantStatus: http.StatusOK, wantPurged: 1},
+		{query: "name=example.com&namespace=192.0.2.53:53", wantStatus: http.StatusOK, wantPurged: 1},
+		{query: "name=example.com&type=BOGUS", wantStatus: http.StatusBadRequest},
+		{query: "name=example.com", wantStatus: http.StatusOK, wantPurged: 1},
+		{query: "suffix=example.com", wantStatus: http.StatusOK, wantPurged: 2},
+		{query: "", wantStatus: http.StatusBadRequest},
+		{query: "all=true", wantStatus: http.StatusOK, wantPurged: 1},
+	}
+	for _, p := range purges {
+		var resp struct {
+			Purged int `json:"purged"`
+		}
+		serveAdmin(t, handler, http.MethodPost, "/purge?"+p.query, p.wantStatus, &resp)
+		if resp.Purged != p.wantPurged {
+			t.Errorf("purge %q: got %d purged; want %d", p.query, resp.Purged, p.wantPurged)
+		}
+	}
+	if n := cache.Stats().Entries; n != 0 {
+		t.Errorf("want no entries after purging all; got %d", n)
+	}
+}
+
+func TestCache_AdminHandler_CustomQuestionCache(t *testing.T) {
+	cache := &Cache{QuestionCache: &mapQuestionCache{}}
+	serveAdmin(t, cache.AdminHandler(), http.MethodPost, "/purge?all=true", http.StatusNotImplemented, nil)
+}
+
+// serveAdmin serves a request to the admin handler and decodes the JSON
+// response into v, if not nil.
+func serveAdmin(t *testing.T, handler http.Handler, method, target string, wantStatus int, v any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if w.Code != wantStatus {
+		t.Fatalf("%s %s: got status %d; want %d; body: %s", method, target, w.Code, wantStatus, w.Body)
+	}
+	if v != nil && wantStatus == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("decode %s %s response: %v", method, target, err)
+		}
+	}
+}
+
+// mapQuestionCache is a minimal QuestionCache without optional interfaces.
+type mapQuestionCache struct {
+	m map[Question]Answer
+}
+
+func (c *mapQuestionCache) Get(q Question) (Answer, bool) {
+	a, ok := c.m[q]
+	return a, ok
+}
+
+func (c *mapQuestionCache) Set(q Question, a Answer) {
+	if c.m == nil {
+		c.m = make(map[Question]Answer)
+	}
+	c.m[q] = a
+}
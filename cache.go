@@ -2,11 +2,20 @@ package dns
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"maps"
 	"net"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
+// defaultStaleTTL is the TTL of stale answers recommended by RFC 8767.
+const defaultStaleTTL = 30 * time.Second
+
 // Cache is a DNS cache that uses net.Resolver for an http.Transport.
 // Typically used to cache DNS queries as part of an http.Client.
 //
@@ -40,8 +49,129 @@ type Cache struct {
 	// If nil, Cache uses a simple in-memory cache.
 	QuestionCache QuestionCache
 
+	// MaxEntries is the maximum number of answers stored in the default,
+	// in-memory cache. When full, the cache evicts the least recently used
+	// answer. Evictions are counted in Stats and reported to the Observer.
+	// Ignored if QuestionCache is set.
+	//
+	// If zero, the cache is unbounded.
+	MaxEntries int
+
+	// ExpiryInterval is how often a background goroutine removes expired
+	// answers from the default, in-memory cache. Call Close to stop the
+	// goroutine. Ignored if QuestionCache is set.
+	//
+	// If zero, expired answers are removed only when a Get finds them.
+	ExpiryInterval time.Duration
+
+	// MaxStale enables serving expired answers when the upstream DNS server
+	// fails, per RFC 8767. If dialing, writing, or reading from the upstream
+	// server fails, or the server responds with SERVFAIL, Cache serves the
+	// expired answer if it expired less than MaxStale ago. Stale responses
+	// include an Extended DNS Error, per RFC 8914.
+	//
+	// Requires a QuestionCache that implements StaleQuestionCache. The default,
+	// in-memory cache retains expired answers for MaxStale.
+	//
+	// If zero, Cache never serves stale answers.
+	MaxStale time.Duration
+
+	// StaleTTL is the TTL of stale answers. If zero, defaults to 30 seconds as
+	// recommended by RFC 8767 section 4.
+	StaleTTL time.Duration
+
+	// NamespaceByServer caches answers separately for each upstream DNS server
+	// address dialed by the resolver. Use for split-horizon DNS, where servers
+	// give different answers for the same question.
+	//
+	// If false, all upstream DNS servers share answers.
+	NamespaceByServer bool
+
+	// RawResponses stores the packed upstream DNS response with each answer.
+	// On a cache hit, Cache replays the upstream response, rewriting only the
+	// transaction ID and TTLs. The response is byte-for-byte faithful,
+	// including the authority and additional sections, header flags, and EDNS0
+	// options. Stale raw responses don't include an Extended DNS Error.
+	//
+	// If false, Cache builds responses from the parsed answer records.
+	RawResponses bool
+
+	// MinTTL is the minimum TTL of cached answers. Answers with a lower TTL,
+	// including zero, are cached for MinTTL. Responses from the cache report
+	// the remaining clamped TTL for every record.
+	//
+	// If zero, answers are cached for the TTL in the upstream response.
+	MinTTL time.Duration
+
+	// MaxTTL is the maximum TTL of cached answers. Answers with a higher TTL are
+	// cached for MaxTTL.
+	//
+	// If zero, answers are cached for the TTL in the upstream response.
+	MaxTTL time.Duration
+
+	// PrefetchThreshold enables refreshing answers before they expire. When a
+	// cache hit occurs within the last PrefetchThreshold fraction of the
+	// answer's TTL, Cache asynchronously queries the upstream DNS server and
+	// replaces the answer. For example, 0.1 refreshes an answer with a 30s TTL
+	// when a hit occurs in the last 3 seconds. Call Close to stop in-progress
+	// refreshes.
+	//
+	// If zero, Cache never refreshes answers before they expire.
+	PrefetchThreshold float64
+
+	// CaseRandomization randomizes the case of the question name in upstream
+	// queries, known as DNS 0x20 encoding. Cache stores an upstream response
+	// only if its question name matches the randomized name exactly, making
+	// spoofed responses harder to cache. Upstream DNS servers that don't
+	// preserve the case of the question name never have answers cached.
+	//
+	// If false, Cache sends the question name as given by the resolver.
+	CaseRandomization bool
+
+	// Observer optionally receives events for cache hits, misses, fills,
+	// evictions, and upstream queries, typically to record metrics. See
+	// ExpvarObserver and PrometheusObserver.
+	//
+	// If nil, events are ignored.
+	Observer Observer
+
+	// Logger optionally logs cache hits, misses, fills, stale answers, upstream
+	// failures, rejected upstream responses, and queries sent upstream without
+	// caching. All messages are logged at debug level.
+	//
+	// If nil, Cache doesn't log.
+	Logger *slog.Logger
+
+	// Tracer optionally starts a span for each query answered by the Cache,
+	// with attributes for the question, whether the answer came from the
+	// cache, the upstream DNS server, and the response code. Spans are
+	// children of the span in the context passed to the resolver.
+	//
+	// If nil, Cache doesn't start spans.
+	Tracer Tracer
+
+	// QueryLog optionally receives an event for each query answered by the
+	// Cache, including the question, whether the answer came from the cache,
+	// the IPs, and the latency. See JSONLinesSink and RingBufferSink.
+	//
+	// If nil, Cache doesn't log queries.
+	QueryLog QuerySink
+
 	initOnce sync.Once
 	resolver *net.Resolver
+	flights  flightGroup
+	stats    cacheStats
+	// resolvConfPath is the resolv.conf with the nameservers for lookup.
+	resolvConfPath string
+
+	// mu guards closed and adding to wg.
+	mu     sync.Mutex
+	closed bool
+	// closeCtx is canceled by Close to stop background goroutines.
+	closeCtx    context.Context
+	closeCancel context.CancelFunc
+	// wg tracks background goroutines.
+	wg sync.WaitGroup
 }
 
 func (c *Cache) init() {
@@ -50,8 +180,34 @@ func (c *Cache) init() {
 		if c.Dial == nil {
 			c.Dial = defaultDialer.DialContext
 		}
+		if c.StaleTTL == 0 {
+			c.StaleTTL = defaultStaleTTL
+		}
+		if c.Observer == nil {
+			c.Observer = nopObserver{}
+		}
+		if c.Logger == nil {
+			c.Logger = slog.New(slog.DiscardHandler)
+		}
+		if c.Tracer == nil {
+			c.Tracer = nopTracer{}
+		}
+		if c.QueryLog == nil {
+			c.QueryLog = nopQuerySink{}
+		}
+		if c.resolvConfPath == "" {
+			c.resolvConfPath = defaultResolvConfPath
+		}
+		c.closeCtx, c.closeCancel = context.WithCancel(context.Background())
 		if c.QuestionCache == nil {
-			c.QuestionCache = newQuestionCache()
+			qc := newQuestionCache()
+			qc.maxEntries = c.MaxEntries
+			qc.maxStale = c.MaxStale
+			qc.onEvict = func(q Question) { c.Observer.Evict(q.Type) }
+			c.QuestionCache = qc
+			if c.ExpiryInterval > 0 {
+				c.goBackground(func(ctx context.Context) { c.sweepExpired(ctx, qc) })
+			}
 		}
 		c.resolver = &net.Resolver{
 			StrictErrors: true,
@@ -66,18 +222,126 @@ func (c *Cache) Resolver() *net.Resolver {
 	return c.resolver
 }
 
+// ErrIterationUnsupported is returned when enumerating the answers of a
+// QuestionCache that doesn't implement IterableQuestionCache.
+var ErrIterationUnsupported = errors.New("dns: question cache doesn't support iteration")
+
+// Snapshot returns a copy of the cached answers, including expired answers
+// retained to serve stale answers. For the default, in-memory cache, the copy
+// is from a single point in time.
+//
+// Returns ErrIterationUnsupported if the QuestionCache doesn't implement
+// IterableQuestionCache.
+func (c *Cache) Snapshot() (map[Question]Answer, error) {
+	c.init()
+	switch qc := c.QuestionCache.(type) {
+	case *questionCache:
+		return qc.Snapshot(), nil
+	case IterableQuestionCache:
+		return maps.Collect(qc.All()), nil
+	default:
+		return nil, ErrIterationUnsupported
+	}
+}
+
+// Close stops background goroutines and waits for them to exit. The Resolver
+// remains usable after Close, but expired answers are no longer removed and
+// answers are no longer refreshed in the background. Close is safe to call
+// multiple times.
+func (c *Cache) Close() error {
+	c.init()
+	c.mu.Lock()
+	c.closed = true
+	c.closeCancel()
+	c.mu.Unlock()
+	c.wg.Wait()
+	return nil
+}
+
+// goBackground runs f in a new goroutine that Close waits for. The context
+// passed to f is canceled by Close. Returns false without running f if the
+// Cache is closed.
+func (c *Cache) goBackground(f func(ctx context.Context)) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f(c.closeCtx)
+	}()
+	return true
+}
+
+// sweepExpired periodically removes expired answers from qc until ctx is
+// done.
+func (c *Cache) sweepExpired(ctx context.Context, qc *questionCache) {
+	ticker := time.NewTicker(c.ExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			qc.removeExpired()
+		}
+	}
+}
+
 func (c *Cache) dial(ctx context.Context, network, addr string) (net.Conn, error) {
-	// Only support UDP for simplicity. TCP prepends a 2-byte length prefix.
 	// The Go resolver tests whether the conn implements net.PacketConn rather
-	// than testing the network string for reads, so TCP support might also need
-	// a new, separate conn type that doesn't implement net.PacketConn.
+	// than testing the network string for reads, so TCP uses a separate conn
+	// type that doesn't implement net.PacketConn.
 	// Test a prefix because udp4 and upd6 are valid network strings.
-	if !strings.HasPrefix(network, "udp") {
+	isUDP := strings.HasPrefix(network, "udp")
+	isTCP := strings.HasPrefix(network, "tcp")
+	if !isUDP && !isTCP {
 		return c.Dial(ctx, network, addr)
 	}
+	conn := c.newConn(ctx, network, addr)
+	if conn.stream {
+		return tcpCacheConn{Conn: conn}, nil
+	}
+	return conn, nil
+}
+
+// namespace returns the Question namespace for the upstream DNS server addr.
+func (c *Cache) namespace(addr string) string {
+	if c.NamespaceByServer {
+		return addr
+	}
+	return ""
+}
+
+// newConn returns a cacheConn that dials network and addr on a cache miss.
+// The network must be a UDP or TCP network.
+func (c *Cache) newConn(ctx context.Context, network, addr string) *cacheConn {
 	conn := &cacheConn{
 		questionCache: c.QuestionCache,
-		dial:          func() (net.Conn, error) { return c.Dial(ctx, network, addr) },
+		namespace:     c.namespace(addr),
+		ctx:           ctx,
+		flights:       &c.flights,
+		stats:         &c.stats,
+		observer:      c.Observer,
+		logger:        c.Logger.With("server", addr),
+		tracer:        c.Tracer,
+		queryLog:      c.QueryLog,
+		span:          nopSpan{},
+		addr:          addr,
+		stream:        strings.HasPrefix(network, "tcp"),
+		maxStale:      c.MaxStale,
+		staleTTL:      c.StaleTTL,
+		rawResponses:  c.RawResponses,
+		minTTL:        c.MinTTL,
+		maxTTL:        c.MaxTTL,
+		randomizeCase: c.CaseRandomization,
+		dial:          func(ctx context.Context) (net.Conn, error) { return c.Dial(ctx, network, addr) },
 	}
-	return conn, nil
+	if c.PrefetchThreshold > 0 {
+		conn.prefetchThreshold = c.PrefetchThreshold
+		conn.prefetch = func(q dnsmessage.Question) { c.prefetch(network, addr, q) }
+	}
+	return conn
 }
@@ -1,10 +1,16 @@
 package dns
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -48,3 +54,1288 @@ func TestCache(t *testing.T) {
 	got = getResolvedAddrs()
 	assertSameAddrs(t, want, got)
 }
+
+func TestCache_TCP(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "test-cache-tcp.example.com")
+
+	// Truncate UDP responses so the Go resolver retries over TCP.
+	handler := fakeDNS.handler
+	tcpQueries := new(atomic.Int64)
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		r, err := handler(network, q)
+		if network == "udp" {
+			r.Truncated = true
+			r.Answers = nil
+		} else {
+			tcpQueries.Add(1)
+		}
+		return r, err
+	}
+
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	got, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", fakeHTTP.FQDN)
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	if tcpQueries.Load() == 0 {
+		t.Fatalf("want DNS queries over TCP; got none")
+	}
+	want := []netip.Addr{fakeHTTP.IP}
+	assertSameAddrs(t, want, got)
+
+	// Second lookup should use the answer cached from TCP.
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		return dnsmessage.Message{}, fmt.Errorf("should not be called")
+	}
+	got, err = cache.Resolver().LookupNetIP(t.Context(), "ip4", fakeHTTP.FQDN)
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	assertSameAddrs(t, want, got)
+}
+
+func TestCache_TCPLargeResponse(t *testing.T) {
+	host := "test-cache-tcp-large.example.com."
+	// 120 A records are about 1900 bytes, more than the 1232 byte UDP size.
+	var want []netip.Addr
+	for i := range 120 {
+		want = append(want, netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)}))
+	}
+
+	for _, raw := range []bool{false, true} {
+		t.Run(fmt.Sprintf("raw=%t", raw), func(t *testing.T) {
+			fakeDNS := startDNSServer(t, host, want[0])
+			handler := fakeDNS.handler
+			fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				r, err := handler(network, q)
+				if network == "udp" {
+					r.Truncated = true
+					r.Answers = nil
+					return r, err
+				}
+				for _, ip := range want[1:] {
+					a := r.Answers[0]
+					a.Body = &dnsmessage.AResource{A: ip.As4()}
+					r.Answers = append(r.Answers, a)
+				}
+				return r, err
+			}
+
+			cache := &Cache{
+				Dial:         fakeDNS.DialContext,
+				RawResponses: raw,
+			}
+			got, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", host)
+			if err != nil {
+				t.Fatalf("LookupNetIP: %v", err)
+			}
+			assertSameAddrs(t, want, got)
+
+			// The cached answer is too large for UDP, so the UDP cache hit is
+			// truncated and the Go resolver retries over TCP, another cache hit.
+			fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				return dnsmessage.Message{}, fmt.Errorf("should not be called")
+			}
+			got, err = cache.Resolver().LookupNetIP(t.Context(), "ip4", host)
+			if err != nil {
+				t.Fatalf("LookupNetIP: %v", err)
+			}
+			assertSameAddrs(t, want, got)
+
+			q := Question{FQDN: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+			resp := exchangeMsg(t, cache, newQueryMsg(t, q))
+			if !resp.Truncated || len(resp.Answers) != 0 {
+				t.Errorf("want truncated UDP response without answers; got header %v, %d answers", resp.Header, len(resp.Answers))
+			}
+		})
+	}
+}
+
+func TestCache_Negative(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "test-cache-negative.example.com")
+
+	tests := []struct {
+		name    string
+		network string
+		host    string
+	}{
+		{name: "NXDOMAIN", network: "ip4", host: "missing." + fakeHTTP.FQDN},
+		{name: "NODATA", network: "ip6", host: fakeHTTP.FQDN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &Cache{
+				Dial: fakeDNS.DialContext,
+			}
+			handler := fakeDNS.handler
+			t.Cleanup(func() { fakeDNS.handler = handler })
+
+			_, err := cache.Resolver().LookupNetIP(t.Context(), tt.network, tt.host)
+			assertNotFound(t, err)
+
+			// Second lookup should use the cached negative answer.
+			fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				return dnsmessage.Message{}, fmt.Errorf("should not be called")
+			}
+			_, err = cache.Resolver().LookupNetIP(t.Context(), tt.network, tt.host)
+			assertNotFound(t, err)
+
+			// The cached negative response includes the SOA record so downstream
+			// caches can cache it.
+			qtype := dnsmessage.TypeA
+			if tt.network == "ip6" {
+				qtype = dnsmessage.TypeAAAA
+			}
+			q := Question{FQDN: tt.host, Type: qtype, Class: dnsmessage.ClassINET}
+			resp := exchangeMsg(t, cache, newQueryMsg(t, q))
+			if len(resp.Authorities) != 1 || resp.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+				t.Fatalf("want SOA authority; got %v", resp.Authorities)
+			}
+			if ttl := resp.Authorities[0].Header.TTL; ttl == 0 || ttl > 30 {
+				t.Errorf("SOA TTL: got %d; want within negative TTL 30", ttl)
+			}
+		})
+	}
+}
+
+func TestCache_CoalesceMisses(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "test-cache-coalesce.example.com")
+
+	// Slow down the upstream query so concurrent cache misses overlap.
+	handler := fakeDNS.handler
+	upstreamQueries := new(atomic.Int64)
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return handler(network, q)
+	}
+
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	cache.init()
+	want := []netip.Addr{fakeHTTP.IP}
+	runParallel(func(int) {
+		// Use a new resolver for each lookup because net.Resolver coalesces
+		// concurrent lookups for the same host.
+		resolver := &net.Resolver{PreferGo: true, Dial: cache.dial}
+		got, err := resolver.LookupNetIP(t.Context(), "ip4", fakeHTTP.FQDN)
+		if err != nil {
+			t.Errorf("LookupNetIP: %v", err)
+			return
+		}
+		assertSameAddrs(t, want, got)
+	})
+
+	if got := upstreamQueries.Load(); got != 1 {
+		t.Errorf("upstream queries: got %d; want 1", got)
+	}
+	stats := cache.Stats()
+	if want := int64(goroutineCount*runCount - 1); stats.Misses != 1 || stats.Hits != want {
+		t.Errorf("stats: got %d hits and %d misses; want %d hits and 1 miss", stats.Hits, stats.Misses, want)
+	}
+}
+
+func TestCache_ServeStale(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "test-cache-stale.example.com")
+	staleIP := netip.MustParseAddr("10.0.0.1")
+
+	tests := []struct {
+		name     string
+		expiry   time.Duration // how long ago the cached answer expired
+		dial     func(ctx context.Context, network, address string) (net.Conn, error)
+		handler  func(network string, q dnsmessage.Message) (dnsmessage.Message, error)
+		want     []netip.Addr
+		wantFail bool
+	}{
+		{
+			name:   "upstream error",
+			expiry: 30 * time.Second,
+			handler: func(string, dnsmessage.Message) (dnsmessage.Message, error) {
+				return dnsmessage.Message{}, fmt.Errorf("upstream unavailable")
+			},
+			want: []netip.Addr{staleIP},
+		},
+		{
+			name:   "SERVFAIL",
+			expiry: 30 * time.Second,
+			handler: func(_ string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				return dnsmessage.Message{
+					Header:    dnsmessage.Header{ID: q.ID, Response: true, RCode: dnsmessage.RCodeServerFailure},
+					Questions: q.Questions,
+				}, nil
+			},
+			want: []netip.Addr{staleIP},
+		},
+		{
+			name:   "dial error",
+			expiry: 30 * time.Second,
+			dial: func(context.Context, string, string) (net.Conn, error) {
+				return nil, fmt.Errorf("dial unavailable")
+			},
+			want: []netip.Addr{staleIP},
+		},
+		{
+			name:   "upstream ok",
+			expiry: 30 * time.Second,
+			want:   []netip.Addr{fakeHTTP.IP},
+		},
+		{
+			name:   "expired past max stale",
+			expiry: 2 * time.Minute,
+			handler: func(string, dnsmessage.Message) (dnsmessage.Message, error) {
+				return dnsmessage.Message{}, fmt.Errorf("upstream unavailable")
+			},
+			wantFail: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := fakeDNS.handler
+			t.Cleanup(func() { fakeDNS.handler = handler })
+			if tt.handler != nil {
+				fakeDNS.handler = tt.handler
+			}
+			cache := &Cache{
+				Dial:     fakeDNS.DialContext,
+				MaxStale: time.Minute,
+			}
+			if tt.dial != nil {
+				cache.Dial = tt.dial
+			}
+			cache.init()
+			cache.QuestionCache.Set(
+				Question{FQDN: fakeHTTP.FQDN, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+				Answer{
+					FetchTime: time.Now().Add(-time.Minute - tt.expiry),
+					TTL:       time.Minute,
+					IPs:       []netip.Addr{staleIP},
+				},
+			)
+
+			got, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", fakeHTTP.FQDN)
+			if tt.wantFail {
+				if err == nil {
+					t.Fatalf("LookupNetIP: want error; got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LookupNetIP: %v", err)
+			}
+			assertSameAddrs(t, tt.want, got)
+		})
+	}
+}
+
+func TestCache_ServeStaleExtendedError(t *testing.T) {
+	fakeDNS := startDNSServer(t, "test-cache-stale.example.com.", netip.MustParseAddr("10.0.0.1"))
+	fakeDNS.handler = func(string, dnsmessage.Message) (dnsmessage.Message, error) {
+		return dnsmessage.Message{}, fmt.Errorf("upstream unavailable")
+	}
+	cache := &Cache{
+		Dial:     fakeDNS.DialContext,
+		MaxStale: time.Minute,
+	}
+	cache.init()
+	q := Question{FQDN: "test-cache-stale.example.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	cache.QuestionCache.Set(q, Answer{
+		FetchTime: time.Now().Add(-90 * time.Second),
+		TTL:       time.Minute,
+		IPs:       []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+	})
+
+	resp := exchangeMsg(t, cache, newQueryMsg(t, q))
+
+	if len(resp.Answers) != 1 || resp.Answers[0].Header.TTL > uint32(defaultStaleTTL/time.Second) {
+		t.Errorf("want 1 answer with stale TTL %s; got %v", defaultStaleTTL, resp.Answers)
+	}
+	if !hasExtendedError(resp, edeStaleAnswer) {
+		t.Errorf("want Extended DNS Error for stale answer; got additionals %v", resp.Additionals)
+	}
+}
+
+// newQueryMsg returns a DNS query for q with an EDNS0 OPT record, like the
+// Go resolver.
+func newQueryMsg(t *testing.T, q Question) dnsmessage.Message {
+	t.Helper()
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatalf("SetEDNS0: %v", err)
+	}
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(q.FQDN),
+			Type:  q.Type,
+			Class: q.Class,
+		}},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}},
+	}
+}
+
+// exchangeMsg sends query over a UDP conn from cache and returns the response.
+func exchangeMsg(t *testing.T, cache *Cache, query dnsmessage.Message) dnsmessage.Message {
+	t.Helper()
+	conn, err := cache.dial(t.Context(), "udp", "127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatalf("pack query: %v", err)
+	}
+	if _, err := conn.Write(packed); err != nil {
+		t.Fatalf("write query: %v", err)
+	}
+	b := make([]byte, 1232)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	resp := dnsmessage.Message{}
+	if err := resp.Unpack(b[:n]); err != nil {
+		t.Fatalf("unpack response: %v", err)
+	}
+	return resp
+}
+
+// hasExtendedError returns true if msg has an Extended DNS Error option with
+// the info code.
+func hasExtendedError(msg dnsmessage.Message, infoCode byte) bool {
+	for _, r := range msg.Additionals {
+		opt, ok := r.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			continue
+		}
+		for _, o := range opt.Options {
+			if o.Code == ednsOptionExtendedError && len(o.Data) >= 2 && o.Data[1] == infoCode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCache_Prefetch(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "test-cache-prefetch.example.com")
+	handler := fakeDNS.handler
+	upstreamQueries := new(atomic.Int64)
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		return handler(network, q)
+	}
+
+	cache := &Cache{
+		Dial:              fakeDNS.DialContext,
+		PrefetchThreshold: 0.5,
+	}
+	t.Cleanup(func() { _ = cache.Close() })
+	cache.init()
+	q := Question{FQDN: fakeHTTP.FQDN, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	oldIP := netip.MustParseAddr("10.0.0.1")
+	// The answer has 20s left of its 60s TTL, within the prefetch threshold.
+	cache.QuestionCache.Set(q, Answer{
+		FetchTime: time.Now().Add(-40 * time.Second),
+		TTL:       time.Minute,
+		IPs:       []netip.Addr{oldIP},
+	})
+
+	// The lookup is a cache hit that triggers a prefetch.
+	got, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", fakeHTTP.FQDN)
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	assertSameAddrs(t, []netip.Addr{oldIP}, got)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		a, ok := cache.QuestionCache.Get(q)
+		if ok && len(a.IPs) == 1 && a.IPs[0] == fakeHTTP.IP {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want prefetched answer with IP %s; got %#v", fakeHTTP.IP, a)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := upstreamQueries.Load(); got != 1 {
+		t.Errorf("upstream queries: got %d; want 1", got)
+	}
+}
+
+func TestCache_PrefetchDialError(t *testing.T) {
+	cache := &Cache{
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("dial failed")
+		},
+		PrefetchThreshold: 0.5,
+	}
+	cache.init()
+	host := "test-cache-prefetch-dial.example.com."
+	q := Question{FQDN: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	ip := netip.MustParseAddr("10.0.0.1")
+	cache.QuestionCache.Set(q, Answer{
+		FetchTime: time.Now().Add(-40 * time.Second),
+		TTL:       time.Minute,
+		IPs:       []netip.Addr{ip},
+	})
+
+	// The lookup is a cache hit that triggers a prefetch, which fails to dial.
+	got, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", host)
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	assertSameAddrs(t, []netip.Addr{ip}, got)
+
+	// Close waits for the prefetch to finish. The failed prefetch must not
+	// leave a flight that later cache misses would wait on.
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	cache.flights.mu.Lock()
+	defer cache.flights.mu.Unlock()
+	if n := len(cache.flights.flights); n != 0 {
+		t.Errorf("want no in-progress flights after failed prefetch; got %d", n)
+	}
+}
+
+func TestCache_PrefetchServerFailure(t *testing.T) {
+	host := "test-cache-prefetch-servfail.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.2"))
+	handler := fakeDNS.handler
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		r, err := handler(network, q)
+		r.RCode = dnsmessage.RCodeServerFailure
+		r.Answers = nil
+		return r, err
+	}
+	cache := &Cache{
+		Dial:              fakeDNS.DialContext,
+		PrefetchThreshold: 0.5,
+		MaxStale:          time.Hour,
+	}
+	cache.init()
+	q := Question{FQDN: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	ip := netip.MustParseAddr("10.0.0.1")
+	cache.QuestionCache.Set(q, Answer{
+		FetchTime: time.Now().Add(-40 * time.Second),
+		TTL:       time.Minute,
+		IPs:       []netip.Addr{ip},
+	})
+
+	// The lookup is a cache hit that triggers a prefetch, which gets SERVFAIL.
+	got, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", host)
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	assertSameAddrs(t, []netip.Addr{ip}, got)
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// No client received a stale answer from the failed prefetch.
+	if stats := cache.Stats(); stats.StaleServes != 0 || stats.UpstreamErrors != 1 {
+		t.Errorf("stats: got %d stale serves and %d upstream errors; want 0 and 1", stats.StaleServes, stats.UpstreamErrors)
+	}
+	if a, ok := cache.QuestionCache.Get(q); !ok || len(a.IPs) != 1 || a.IPs[0] != ip {
+		t.Errorf("want the original answer to remain cached; got %#v, %t", a, ok)
+	}
+}
+
+func TestCache_RemainingTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		ttl     time.Duration
+		wantTTL uint32
+	}{
+		{name: "fresh", age: 0, ttl: 30 * time.Second, wantTTL: 29},
+		{name: "partially elapsed", age: 25 * time.Second, ttl: 30 * time.Second, wantTTL: 4},
+		{name: "about to expire", age: 29900 * time.Millisecond, ttl: 30 * time.Second, wantTTL: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &Cache{
+				Dial: func(context.Context, string, string) (net.Conn, error) {
+					return nil, fmt.Errorf("should not be called")
+				},
+			}
+			cache.init()
+			q := Question{FQDN: "test-cache-ttl.example.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+			cache.QuestionCache.Set(q, Answer{
+				FetchTime: time.Now().Add(-tt.age),
+				TTL:       tt.ttl,
+				IPs:       []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			})
+
+			resp := exchangeMsg(t, cache, newQueryMsg(t, q))
+
+			if len(resp.Answers) != 1 {
+				t.Fatalf("want 1 answer; got %v", resp.Answers)
+			}
+			if got := resp.Answers[0].Header.TTL; got != tt.wantTTL {
+				t.Errorf("TTL: got %d; want %d", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestCache_ClampTTL(t *testing.T) {
+	tests := []struct {
+		name        string
+		minTTL      time.Duration
+		maxTTL      time.Duration
+		upstreamTTL uint32
+		wantTTL     time.Duration
+	}{
+		{name: "no clamp", upstreamTTL: 60, wantTTL: 60 * time.Second},
+		{name: "min TTL", minTTL: 10 * time.Second, upstreamTTL: 0, wantTTL: 10 * time.Second},
+		{name: "max TTL", maxTTL: 5 * time.Second, upstreamTTL: 60, wantTTL: 5 * time.Second},
+		{name: "within clamps", minTTL: 10 * time.Second, maxTTL: time.Minute, upstreamTTL: 30, wantTTL: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeHTTP, fakeDNS := startServers(t, "test-cache-clamp.example.com")
+			handler := fakeDNS.handler
+			fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				r, err := handler(network, q)
+				for i := range r.Answers {
+					r.Answers[i].Header.TTL = tt.upstreamTTL
+				}
+				return r, err
+			}
+			cache := &Cache{
+				Dial:   fakeDNS.DialContext,
+				MinTTL: tt.minTTL,
+				MaxTTL: tt.maxTTL,
+			}
+
+			if _, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", fakeHTTP.FQDN); err != nil {
+				t.Fatalf("LookupNetIP: %v", err)
+			}
+
+			a, ok := cache.QuestionCache.Get(Question{FQDN: fakeHTTP.FQDN, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+			if !ok {
+				t.Fatalf("want cached answer; got missing")
+			}
+			if a.TTL != tt.wantTTL {
+				t.Errorf("TTL: got %s; want %s", a.TTL, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestCache_ClampTTLRecords(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		t.Run(fmt.Sprintf("raw=%t", raw), func(t *testing.T) {
+			_, fakeDNS := startServers(t, "test-cache-clamp-records.example.com")
+			alias := "test-cache-clamp-records.example.com."
+			target := "txt.example.net."
+			fakeDNS.handler = func(_ string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				return dnsmessage.Message{
+					Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+					Questions: q.Questions,
+					Answers: []dnsmessage.Resource{
+						newCNAMEResource(alias, target, 0),
+						{
+							Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(target), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+							Body:   &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}},
+						},
+					},
+				}, nil
+			}
+			cache := &Cache{
+				Dial:         fakeDNS.DialContext,
+				MinTTL:       time.Minute,
+				RawResponses: raw,
+			}
+			cache.init()
+			q := Question{FQDN: alias, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}
+			exchangeMsg(t, cache, newQueryMsg(t, q))
+
+			// Every record of the cache hit reports the clamped TTL, not the
+			// upstream TTL of 0.
+			resp := exchangeMsg(t, cache, newQueryMsg(t, q))
+			if len(resp.Answers) != 2 {
+				t.Fatalf("want 2 answers; got %v", resp.Answers)
+			}
+			for _, r := range resp.Answers {
+				if got := r.Header.TTL; got < 59 || got > 60 {
+					t.Errorf("%s TTL: got %d; want about 59", r.Header.Type, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_CNAME(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "lb.example.net")
+	alias := "test-cache-cname.example.com."
+	// Respond to the alias with a CNAME chain: alias -> edge -> lb.
+	handler := fakeDNS.handler
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		if len(q.Questions) != 1 || q.Questions[0].Name.String() != alias {
+			return handler(network, q)
+		}
+		target := q
+		target.Questions = []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(fakeHTTP.FQDN),
+			Type:  q.Questions[0].Type,
+			Class: q.Questions[0].Class,
+		}}
+		r, err := handler(network, target)
+		r.Questions = q.Questions
+		r.Answers = append([]dnsmessage.Resource{
+			newCNAMEResource(alias, "edge.example.org.", 300),
+			newCNAMEResource("edge.example.org.", fakeHTTP.FQDN, 120),
+		}, r.Answers...)
+		return r, err
+	}
+
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	want := []netip.Addr{fakeHTTP.IP}
+	got, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", alias)
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	assertSameAddrs(t, want, got)
+
+	q := Question{FQDN: alias, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	a, ok := cache.QuestionCache.Get(q)
+	if !ok {
+		t.Fatalf("want cached answer; got missing")
+	}
+	wantAnswer := Answer{
+		FetchTime: a.FetchTime,
+		TTL:       60 * time.Second,
+		Flags:     ResponseFlags{RecursionAvailable: true},
+		CNAMEs: []CNAME{
+			{Name: alias, Target: "edge.example.org.", TTL: 300 * time.Second},
+			{Name: "edge.example.org.", Target: fakeHTTP.FQDN, TTL: 120 * time.Second},
+		},
+		IPs: want,
+	}
+	assertSameAnswer(t, wantAnswer, a)
+
+	// Second lookup should use the cached CNAME chain.
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		return dnsmessage.Message{}, fmt.Errorf("should not be called")
+	}
+	got, err = cache.Resolver().LookupNetIP(t.Context(), "ip4", alias)
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	assertSameAddrs(t, want, got)
+
+	resp := exchangeMsg(t, cache, newQueryMsg(t, q))
+	wantNames := []string{alias, "edge.example.org.", fakeHTTP.FQDN}
+	if len(resp.Answers) != len(wantNames) {
+		t.Fatalf("want %d answers; got %v", len(wantNames), resp.Answers)
+	}
+	for i, r := range resp.Answers {
+		if got := r.Header.Name.String(); got != wantNames[i] {
+			t.Errorf("answer %d name: got %s; want %s", i, got, wantNames[i])
+		}
+	}
+}
+
+func TestCache_RecordTypes(t *testing.T) {
+	_, fakeDNS := startServers(t, "test-cache-records.example.com")
+	srvName := "_http._tcp.test-cache-records.example.com."
+	txtName := "test-cache-records.example.com."
+	handler := fakeDNS.handler
+	upstreamQueries := new(atomic.Int64)
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		if len(q.Questions) != 1 {
+			return handler(network, q)
+		}
+		header := dnsmessage.ResourceHeader{
+			Name:  q.Questions[0].Name,
+			Type:  q.Questions[0].Type,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		}
+		var body dnsmessage.ResourceBody
+		switch {
+		case q.Questions[0].Type == dnsmessage.TypeSRV && q.Questions[0].Name.String() == srvName:
+			body = &dnsmessage.SRVResource{
+				Priority: 10,
+				Weight:   5,
+				Port:     8080,
+				Target:   dnsmessage.MustNewName("web.test-cache-records.example.com."),
+			}
+		case q.Questions[0].Type == dnsmessage.TypeTXT && q.Questions[0].Name.String() == txtName:
+			body = &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all"}}
+		default:
+			return handler(network, q)
+		}
+		return dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+			Answers:   []dnsmessage.Resource{{Header: header, Body: body}},
+		}, nil
+	}
+
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	resolver := cache.Resolver()
+	for range 2 {
+		_, srvs, err := resolver.LookupSRV(t.Context(), "", "", srvName)
+		if err != nil {
+			t.Fatalf("LookupSRV: %v", err)
+		}
+		if len(srvs) != 1 || srvs[0].Port != 8080 || srvs[0].Target != "web.test-cache-records.example.com." {
+			t.Errorf("LookupSRV: got %+v; want port 8080 target web.test-cache-records.example.com.", srvs)
+		}
+
+		txts, err := resolver.LookupTXT(t.Context(), txtName)
+		if err != nil {
+			t.Fatalf("LookupTXT: %v", err)
+		}
+		if len(txts) != 1 || txts[0] != "v=spf1 -all" {
+			t.Errorf("LookupTXT: got %q; want [v=spf1 -all]", txts)
+		}
+	}
+
+	// The second lookups should use the cache.
+	if got := upstreamQueries.Load(); got != 2 {
+		t.Errorf("upstream queries: got %d; want 2", got)
+	}
+}
+
+func TestCache_RawResponses(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "test-cache-raw.example.com")
+	handler := fakeDNS.handler
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		r, err := handler(network, q)
+		r.AuthenticData = true
+		r.RecursionAvailable = true
+		r.Authorities = append(r.Authorities, newSOAResource(fakeHTTP.FQDN))
+		return r, err
+	}
+
+	cache := &Cache{
+		Dial:         fakeDNS.DialContext,
+		RawResponses: true,
+	}
+	q := Question{FQDN: fakeHTTP.FQDN, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if _, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", fakeHTTP.FQDN); err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		return dnsmessage.Message{}, fmt.Errorf("should not be called")
+	}
+	query := newQueryMsg(t, q)
+	query.ID = 1234
+	resp := exchangeMsg(t, cache, query)
+
+	if resp.ID != query.ID {
+		t.Errorf("ID: got %d; want %d", resp.ID, query.ID)
+	}
+	if !resp.AuthenticData {
+		t.Errorf("want AD flag from upstream response")
+	}
+	if len(resp.Authorities) != 1 || resp.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+		t.Errorf("want SOA authority from upstream response; got %v", resp.Authorities)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Header.TTL > 60 {
+		t.Errorf("want 1 answer with TTL at most 60; got %v", resp.Answers)
+	}
+}
+
+func TestCache_ResponseFlags(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "test-cache-flags.example.com")
+	handler := fakeDNS.handler
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		r, err := handler(network, q)
+		r.Authoritative = true
+		r.AuthenticData = true
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		r.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+		return r, err
+	}
+
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	if _, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", fakeHTTP.FQDN); err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	q := Question{FQDN: fakeHTTP.FQDN, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	// The query OPT record has a UDP size of 1232 and no DO bit.
+	resp := exchangeMsg(t, cache, newQueryMsg(t, q))
+	if !resp.Authoritative || !resp.RecursionAvailable || !resp.AuthenticData {
+		t.Errorf("want AA, RA, and AD flags from upstream; got header %v", resp.Header)
+	}
+	if len(resp.Additionals) != 1 || resp.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+		t.Fatalf("want 1 OPT record; got %v", resp.Additionals)
+	}
+	if opt := resp.Additionals[0].Header; opt.Class != 4096 || !opt.DNSSECAllowed() {
+		t.Errorf("want upstream OPT record with UDP size 4096 and DO bit; got %v", opt)
+	}
+
+	// Without an OPT record in the query, the response has none.
+	query := newQueryMsg(t, q)
+	query.Additionals = nil
+	resp = exchangeMsg(t, cache, query)
+	if len(resp.Additionals) != 0 {
+		t.Errorf("want no OPT record; got %v", resp.Additionals)
+	}
+}
+
+func TestCache_NamespaceByServer(t *testing.T) {
+	host := "test-cache-namespace.example.com."
+	internalIP := netip.MustParseAddr("10.0.0.1")
+	externalIP := netip.MustParseAddr("203.0.113.1")
+	internalDNS := startDNSServer(t, host, internalIP)
+	externalDNS := startDNSServer(t, host, externalIP)
+	servers := map[string]*dnsServer{
+		"10.0.0.53:53":    internalDNS,
+		"203.0.113.53:53": externalDNS,
+	}
+
+	cache := &Cache{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return servers[addr].DialContext(ctx, network, addr)
+		},
+		NamespaceByServer: true,
+	}
+	cache.init()
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(host),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}
+	for range 2 {
+		for addr, wantIP := range map[string]netip.Addr{"10.0.0.53:53": internalIP, "203.0.113.53:53": externalIP} {
+			resp, err := cache.exchange(t.Context(), "udp", addr, q)
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+			if len(resp.Answers) != 1 || netip.AddrFrom4(resp.Answers[0].Body.(*dnsmessage.AResource).A) != wantIP {
+				t.Errorf("server %s: want answer %s; got %v", addr, wantIP, resp.Answers)
+			}
+		}
+		// The second round should use the cache.
+		for _, s := range servers {
+			s.handler = func(string, dnsmessage.Message) (dnsmessage.Message, error) {
+				return dnsmessage.Message{}, fmt.Errorf("should not be called")
+			}
+		}
+	}
+}
+
+func TestCache_Class(t *testing.T) {
+	host := "test-cache-class.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+	handler := fakeDNS.handler
+	upstreamQueries := new(atomic.Int64)
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		return handler(network, q)
+	}
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	cache.init()
+	cache.QuestionCache.Set(
+		Question{FQDN: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Answer{FetchTime: time.Now(), TTL: time.Minute, IPs: []netip.Addr{netip.MustParseAddr("10.0.0.1")}},
+	)
+
+	// A CHAOS class question must not use the INET class answer.
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(host),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassCHAOS,
+	}
+	resp, err := cache.exchange(t.Context(), "udp", "127.0.0.1:53", q)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if len(resp.Answers) != 0 {
+		t.Errorf("want no answers for CHAOS class; got %v", resp.Answers)
+	}
+	if got := upstreamQueries.Load(); got != 1 {
+		t.Errorf("upstream queries: got %d; want 1", got)
+	}
+}
+
+func TestCache_CaseInsensitive(t *testing.T) {
+	host := "test-cache-case.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+	handler := fakeDNS.handler
+	upstreamQueries := new(atomic.Int64)
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		return handler(network, q)
+	}
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	for _, name := range []string{"Test-Cache-CASE.example.com.", host} {
+		resolver := &net.Resolver{PreferGo: true, Dial: cache.Resolver().Dial}
+		if _, err := resolver.LookupNetIP(t.Context(), "ip4", name); err != nil {
+			t.Fatalf("LookupNetIP %s: %v", name, err)
+		}
+	}
+	// The second lookup should use the cache.
+	if got := upstreamQueries.Load(); got != 1 {
+		t.Errorf("upstream queries: got %d; want 1", got)
+	}
+}
+
+func TestCache_CaseRandomization(t *testing.T) {
+	host := "test-cache-case-randomization.example.com."
+	tests := []struct {
+		name string
+		// preserveCase is true if the upstream server echoes the question name.
+		preserveCase        bool
+		wantUpstreamQueries int64
+	}{
+		{name: "preserve case", preserveCase: true, wantUpstreamQueries: 1},
+		{name: "lowercase", preserveCase: false, wantUpstreamQueries: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+			handler := fakeDNS.handler
+			var upstreamNames []string
+			fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				upstreamNames = append(upstreamNames, q.Questions[0].Name.String())
+				r, err := handler(network, q)
+				if !tt.preserveCase {
+					r.Questions[0].Name = dnsmessage.MustNewName(host)
+				}
+				return r, err
+			}
+			cache := &Cache{
+				Dial:              fakeDNS.DialContext,
+				CaseRandomization: true,
+			}
+			for range 2 {
+				ips, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", host)
+				if err != nil {
+					t.Fatalf("LookupNetIP: %v", err)
+				}
+				assertSameAddrs(t, []netip.Addr{netip.MustParseAddr("10.0.0.1")}, ips)
+			}
+			if got := int64(len(upstreamNames)); got != tt.wantUpstreamQueries {
+				t.Errorf("upstream queries: got %d; want %d", got, tt.wantUpstreamQueries)
+			}
+			// With 36 letters, an unchanged name is vanishingly unlikely.
+			for _, name := range upstreamNames {
+				if name == host || !strings.EqualFold(name, host) {
+					t.Errorf("upstream name %q: want randomized case of %q", name, host)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_RejectInvalidResponse(t *testing.T) {
+	host := "test-cache-reject.example.com."
+	tests := []struct {
+		name   string
+		modify func(r *dnsmessage.Message)
+	}{
+		{name: "not a response", modify: func(r *dnsmessage.Message) { r.Response = false }},
+		{name: "id mismatch", modify: func(r *dnsmessage.Message) { r.ID++ }},
+		{name: "no questions", modify: func(r *dnsmessage.Message) { r.Questions = nil }},
+		{name: "question name mismatch", modify: func(r *dnsmessage.Message) {
+			r.Questions[0].Name = dnsmessage.MustNewName("other.example.com.")
+		}},
+		{name: "question type mismatch", modify: func(r *dnsmessage.Message) { r.Questions[0].Type = dnsmessage.TypeAAAA }},
+		{name: "unrelated answer owner", modify: func(r *dnsmessage.Message) {
+			r.Answers[0].Header.Name = dnsmessage.MustNewName("victim.example.com.")
+		}},
+		{name: "unrelated cname owner", modify: func(r *dnsmessage.Message) {
+			r.Answers = append([]dnsmessage.Resource{
+				newCNAMEResource("victim.example.com.", host, 60),
+			}, r.Answers...)
+		}},
+		{name: "answer type mismatch", modify: func(r *dnsmessage.Message) {
+			r.Answers[0].Header.Type = dnsmessage.TypeAAAA
+			r.Answers[0].Body = &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()}
+		}},
+		{name: "answer class mismatch", modify: func(r *dnsmessage.Message) { r.Answers[0].Header.Class = dnsmessage.ClassCHAOS }},
+		{name: "unrelated dname owner", modify: func(r *dnsmessage.Message) {
+			r.Answers = append(r.Answers, newDNAMEResource("victim.example.com.", "example.net."))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+			handler := fakeDNS.handler
+			fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				r, err := handler(network, q)
+				tt.modify(&r)
+				return r, err
+			}
+			cache := &Cache{
+				Dial: fakeDNS.DialContext,
+			}
+			cache.init()
+			q := Question{FQDN: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+			conn, err := cache.dial(t.Context(), "udp", "127.0.0.1:53")
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			query := newQueryMsg(t, q)
+			packed, err := query.Pack()
+			if err != nil {
+				t.Fatalf("pack query: %v", err)
+			}
+			if _, err := conn.Write(packed); err != nil {
+				t.Fatalf("write query: %v", err)
+			}
+			if _, err := conn.Read(make([]byte, 1232)); err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if err := conn.Close(); err == nil {
+				t.Errorf("close: want rejection error")
+			}
+
+			if a, ok := cache.QuestionCache.Get(q); ok {
+				t.Errorf("want no cached answer; got %#v", a)
+			}
+			if got := cache.stats.rejected.Load(); got != 1 {
+				t.Errorf("rejected responses: got %d; want 1", got)
+			}
+		})
+	}
+}
+
+func TestCache_UncacheableRCode(t *testing.T) {
+	host := "test-cache-uncacheable.example.com."
+	for _, rcode := range []dnsmessage.RCode{dnsmessage.RCodeServerFailure, dnsmessage.RCodeRefused} {
+		t.Run(rcode.String(), func(t *testing.T) {
+			fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+			handler := fakeDNS.handler
+			fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+				r, err := handler(network, q)
+				r.RCode = rcode
+				r.Answers = nil
+				return r, err
+			}
+			cache := &Cache{
+				Dial: fakeDNS.DialContext,
+			}
+			cache.init()
+			q := Question{FQDN: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+			// A valid response that isn't cached isn't an error.
+			resp := exchangeMsg(t, cache, newQueryMsg(t, q))
+			if resp.RCode != rcode {
+				t.Errorf("rcode: got %s; want %s", resp.RCode, rcode)
+			}
+			if a, ok := cache.QuestionCache.Get(q); ok {
+				t.Errorf("want no cached answer; got %#v", a)
+			}
+			if got := cache.stats.rejected.Load(); got != 0 {
+				t.Errorf("rejected responses: got %d; want 0", got)
+			}
+		})
+	}
+}
+
+func TestCache_DNAME(t *testing.T) {
+	fakeHTTP, fakeDNS := startServers(t, "api.example.net")
+	alias := "api.test-cache-dname.example.com."
+	// Respond with a DNAME record redirecting test-cache-dname.example.com to
+	// example.net and the CNAME record synthesized from it.
+	handler := fakeDNS.handler
+	upstreamQueries := new(atomic.Int64)
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		if len(q.Questions) != 1 || q.Questions[0].Name.String() != alias {
+			return handler(network, q)
+		}
+		target := q
+		target.Questions = []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(fakeHTTP.FQDN),
+			Type:  q.Questions[0].Type,
+			Class: q.Questions[0].Class,
+		}}
+		r, err := handler(network, target)
+		r.Questions = q.Questions
+		r.Answers = append([]dnsmessage.Resource{
+			newDNAMEResource("test-cache-dname.example.com.", "example.net."),
+			newCNAMEResource(alias, fakeHTTP.FQDN, 60),
+		}, r.Answers...)
+		return r, err
+	}
+
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	want := []netip.Addr{fakeHTTP.IP}
+	for range 2 {
+		got, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", alias)
+		if err != nil {
+			t.Fatalf("LookupNetIP: %v", err)
+		}
+		assertSameAddrs(t, want, got)
+	}
+
+	// The second lookup should use the cache.
+	if got := upstreamQueries.Load(); got != 1 {
+		t.Errorf("upstream queries: got %d; want 1", got)
+	}
+	if got := cache.stats.rejected.Load(); got != 0 {
+		t.Errorf("rejected responses: got %d; want 0", got)
+	}
+}
+
+func TestCache_Logger(t *testing.T) {
+	host := "test-cache-logger.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+	var logs bytes.Buffer
+	cache := &Cache{
+		Dial:   fakeDNS.DialContext,
+		Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	cache.init()
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeA, dnsmessage.TypeALL} {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(host), Type: typ, Class: dnsmessage.ClassINET}
+		if _, err := cache.exchange(t.Context(), "udp", "127.0.0.1:53", q); err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+	}
+
+	got := logs.String()
+	for _, want := range []string{
+		`msg="dns cache miss" server=127.0.0.1:53 question=test-cache-logger.example.com. type=A`,
+		`msg="dns cache fill" server=127.0.0.1:53 question=test-cache-logger.example.com. type=A rcode=RCodeSuccess ttl=1m0s ips=1`,
+		`msg="dns cache hit" server=127.0.0.1:53 question=test-cache-logger.example.com. type=A remaining_ttl=`,
+		`msg="dns cache passthrough for uncacheable type" server=127.0.0.1:53 question=test-cache-logger.example.com. type=ALL`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("logs missing %s\ngot:\n%s", want, got)
+		}
+	}
+}
+
+func TestCache_Delete(t *testing.T) {
+	host := "test-cache-delete.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+	handler := fakeDNS.handler
+	upstreamQueries := new(atomic.Int64)
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		return handler(network, q)
+	}
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	lookup := func() {
+		t.Helper()
+		if _, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", host); err != nil {
+			t.Fatalf("LookupNetIP: %v", err)
+		}
+	}
+
+	lookup()
+	ok, err := cache.Delete(Question{FQDN: "Test-Cache-Delete.example.com", Type: dnsmessage.TypeA})
+	if err != nil || !ok {
+		t.Fatalf("Delete: got %v, %v; want true, nil", ok, err)
+	}
+	// The lookup after Delete should query upstream.
+	lookup()
+	lookup()
+	if got := upstreamQueries.Load(); got != 2 {
+		t.Errorf("upstream queries: got %d; want 2", got)
+	}
+
+	if n, err := cache.PurgeSuffix("example.com"); err != nil || n != 1 {
+		t.Errorf("PurgeSuffix: got %d, %v; want 1, nil", n, err)
+	}
+
+	custom := &Cache{QuestionCache: &mapQuestionCache{}}
+	if _, err := custom.Purge(); !errors.Is(err, ErrPurgeUnsupported) {
+		t.Errorf("Purge with custom cache: got %v; want ErrPurgeUnsupported", err)
+	}
+}
+
+func TestCache_Snapshot(t *testing.T) {
+	host := "test-cache-snapshot.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	if _, err := cache.Resolver().LookupNetIP(t.Context(), "ip4", host); err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+
+	snapshot, err := cache.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	q := Question{FQDN: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if a, ok := snapshot[q]; len(snapshot) != 1 || !ok || len(a.IPs) != 1 {
+		t.Errorf("Snapshot: want answer for %s; got %v", host, snapshot)
+	}
+
+	custom := &Cache{QuestionCache: &mapQuestionCache{}}
+	if _, err := custom.Snapshot(); !errors.Is(err, ErrIterationUnsupported) {
+		t.Errorf("Snapshot with custom cache: got %v; want ErrIterationUnsupported", err)
+	}
+}
+
+func TestCache_ExpiryInterval(t *testing.T) {
+	cache := &Cache{ExpiryInterval: time.Millisecond}
+	cache.init()
+	qc := cache.QuestionCache.(*questionCache)
+
+	q1 := Question{FQDN: "test-cache-expiry.example.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	qc.Set(q1, Answer{
+		FetchTime: time.Now(),
+		TTL:       time.Millisecond,
+		IPs:       []netip.Addr{netip.MustParseAddr("1.2.3.4")},
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		qc.mu.Lock()
+		n := len(qc.m)
+		qc.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want expired answer removed in background; got %d entries", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Close is idempotent.
+	if err := cache.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func assertNotFound(t *testing.T, err error) {
+	t.Helper()
+	dnsErr := &net.DNSError{}
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("want not found DNS error; got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// canonicalName returns name with ASCII letters in lowercase. DNS names are
+// case-insensitive, per RFC 4343, so only ASCII letters are folded.
+func canonicalName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if 'A' <= name[i] && name[i] <= 'Z' {
+			b := []byte(name)
+			for j := i; j < len(b); j++ {
+				if 'A' <= b[j] && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return name
+}
+
+// canonicalFQDN returns name in lowercase with a trailing dot, like the FQDN
+// of a Question.
+func canonicalFQDN(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return canonicalName(name)
+}
+
+// hasNameSuffix returns true if fqdn is suffix or a subdomain of suffix. Both
+// must be canonical FQDNs.
+func hasNameSuffix(fqdn, suffix string) bool {
+	return suffix == "." || fqdn == suffix || strings.HasSuffix(fqdn, "."+suffix)
+}
+
+// randomizeNameCase randomizes the case of each ASCII letter in the question
+// name of the packed DNS query msg in place, known as DNS 0x20 encoding.
+// Returns the randomized name.
+//
+// Label length bytes are at most 63, so they're never mistaken for letters.
+func randomizeNameCase(msg []byte) (string, error) {
+	end, err := skipName(msg, headerLen)
+	if err != nil {
+		return "", fmt.Errorf("skip question name: %w", err)
+	}
+	name := msg[headerLen:end]
+	bits := make([]byte, len(name))
+	if _, err := rand.Read(bits); err != nil {
+		return "", fmt.Errorf("generate random case: %w", err)
+	}
+	for i, ch := range name {
+		isLetter := ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')
+		if isLetter && bits[i]&1 == 1 {
+			name[i] ^= 0x20
+		}
+	}
+
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return "", fmt.Errorf("parse randomized query header: %w", err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		return "", fmt.Errorf("parse randomized question: %w", err)
+	}
+	return q.Name.String(), nil
+}
@@ -2,19 +2,41 @@ package dns
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"slices"
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
+const (
+	// ednsOptionExtendedError is the EDNS0 option code for Extended DNS Errors,
+	// per RFC 8914.
+	ednsOptionExtendedError = 15
+	// edeStaleAnswer is the Extended DNS Error info code for a stale answer.
+	edeStaleAnswer = 3
+)
+
 var (
 	_ net.Conn       = (*cacheConn)(nil)
 	_ net.PacketConn = (*cacheConn)(nil)
+	_ net.Conn       = tcpCacheConn{}
 )
 
+// tcpCacheConn is a cacheConn for stream transports, like TCP.
+//
+// The Go resolver uses stream framing, a 2-byte length prefix, for conns that
+// don't implement net.PacketConn. Embedding the net.Conn interface rather than
+// *cacheConn hides the net.PacketConn methods of cacheConn.
+type tcpCacheConn struct {
+	net.Conn
+}
+
 // cacheConn is a read-through cache implementing net.Conn.
 // Parses DNS requests, and returns cached DNS responses on cache hit.
 // On a cache miss, delegates to a real conn and caches the results.
@@ -24,15 +46,88 @@ type cacheConn struct {
 	realConn net.Conn
 	// questionCache is the DNS cache.
 	questionCache QuestionCache
+	// namespace is the Question namespace for cache lookups.
+	namespace string
 	// dial creates realConn on a cache miss.
-	dial func() (net.Conn, error)
-	// cachedResp is the cached DNS response. Nil until the first write. Never set
-	// on a cache miss.
+	dial func(ctx context.Context) (net.Conn, error)
+	// addr is the address of the upstream DNS server.
+	addr string
+	// ctx is the context from dialing the conn, including the span started on
+	// Write. Bounds how long the conn waits for another conn's upstream query.
+	ctx context.Context
+	// flights coalesces concurrent cache misses for the same question. Nil
+	// disables coalescing.
+	flights *flightGroup
+	// flight is the in-progress upstream query led by this conn. Finished on
+	// Close. Nil unless this conn leads the upstream query for flightQuestion.
+	flight         *flight
+	flightQuestion Question
+	// stats counts events for the Cache.
+	stats *cacheStats
+	// observer receives events for the Cache.
+	observer Observer
+	// logger logs events at debug level with the upstream server address.
+	logger *slog.Logger
+	// tracer starts the span on Write.
+	tracer Tracer
+	// span is the span for the query, ended on Close. A nopSpan until Write.
+	span Span
+	// coalesced is true if the conn waited for another conn's upstream query.
+	coalesced bool
+	// queryLog receives event on Close.
+	queryLog QuerySink
+	// event describes the query for queryLog. Zero until Write.
+	event QueryEvent
+	// qtype is the type of the question. Zero if the query has multiple
+	// questions.
+	qtype dnsmessage.Type
+	// upstreamStart is when the query was sent to the upstream DNS server.
+	// Zero after observing the upstream latency.
+	upstreamStart time.Time
+	// stream is true if DNS messages are prefixed with a 2-byte length as
+	// required by RFC 7766 section 8 for TCP.
+	stream bool
+	// maxStale is how long after expiry an answer may be served when the
+	// upstream DNS server fails. Zero disables serving stale answers.
+	maxStale time.Duration
+	// staleTTL is the TTL of stale answers.
+	staleTTL time.Duration
+	// rawResponses stores the packed upstream response in Answer.Raw.
+	rawResponses bool
+	// minTTL and maxTTL clamp the TTL of answers stored in the cache. Zero
+	// means no clamp.
+	minTTL time.Duration
+	maxTTL time.Duration
+	// prefetch asynchronously refreshes the answer for a question. Called on a
+	// cache hit within the last prefetchThreshold fraction of the answer's TTL.
+	// Nil disables prefetching.
+	prefetch          func(q dnsmessage.Question)
+	prefetchThreshold float64
+	// randomizeCase randomizes the case of the question name in the upstream
+	// query on a cache miss.
+	randomizeCase bool
+	// upstreamName is the randomized question name sent upstream. The response
+	// is cached only if its question name matches exactly. Empty unless
+	// randomizeCase is true.
+	upstreamName string
+	// query is the parsed DNS request. Set on a cache miss to validate the
+	// upstream response and to build a stale response if the upstream DNS
+	// server fails.
+	query *dnsmessage.Message
+	// readDeadline and writeDeadline are applied to realConn after dialing.
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// cachedResp is the cached DNS response. Nil until the first write. Only set
+	// on a cache miss when serving a stale answer.
 	cachedResp *bytes.Reader
-	// realResp is the DNS response from the real connection. Incrementally
-	// written by Read calls and stored in the cache on Close.
+	// realResp is the DNS response from the real connection. Written by Read
+	// calls and stored in the cache on Close. Includes the length prefix for
+	// stream conns.
 	// Not used on a cache hit. Nil until the first Read.
 	realResp []byte
+	// realRespReader returns realResp for Read calls on stream conns. Stream
+	// conns read the complete response before returning any of it.
+	realRespReader *bytes.Reader
 }
 
 func (c *cacheConn) Read(b []byte) (int, error) {
@@ -45,14 +140,70 @@ func (c *cacheConn) Read(b []byte) (int, error) {
 		return 0, fmt.Errorf("read from conn on cache miss without a real connection")
 	}
 
+	if c.realRespReader != nil {
+		return c.realRespReader.Read(b)
+	}
+
 	// Cache miss. Read from the real connection and store the response so we can
 	// cache it on Close.
-	n, err := c.realConn.Read(b)
+	resp, err := c.readRealResp(b)
+	if err == nil && !c.upstreamStart.IsZero() {
+		c.observer.UpstreamLatency(c.qtype, time.Since(c.upstreamStart))
+		c.upstreamStart = time.Time{}
+	}
+	if err != nil || isServerFailure(resp) {
+		if err == nil {
+			c.upstreamError("read", errors.New("server failure"))
+		} else {
+			c.upstreamError("read", err)
+		}
+		if c.serveStale() {
+			return c.cachedResp.Read(b)
+		}
+	}
 	if err != nil {
-		return n, err
+		return 0, err
+	}
+	if c.stream {
+		c.realRespReader = bytes.NewReader(c.realResp)
+		return c.realRespReader.Read(b)
 	}
-	c.realResp = append(c.realResp, b[:n]...)
-	return n, err
+	return len(resp), nil
+}
+
+// readRealResp reads a DNS response from the real connection into realResp
+// and returns the DNS message without any length prefix. For packet conns,
+// reads a single datagram into b. For stream conns, reads the complete
+// length-prefixed message.
+func (c *cacheConn) readRealResp(b []byte) ([]byte, error) {
+	if !c.stream {
+		n, err := c.realConn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		c.realResp = append(c.realResp[:0], b[:n]...)
+		return b[:n], nil
+	}
+
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(c.realConn, prefix); err != nil {
+		return nil, err
+	}
+	l := int(prefix[0])<<8 | int(prefix[1])
+	resp := make([]byte, 2+l)
+	copy(resp, prefix)
+	if _, err := io.ReadFull(c.realConn, resp[2:]); err != nil {
+		return nil, err
+	}
+	c.realResp = resp
+	return resp[2:], nil
+}
+
+// isServerFailure returns true if the DNS message has a SERVFAIL response code.
+func isServerFailure(msg []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	return err == nil && h.RCode == dnsmessage.RCodeServerFailure
 }
 
 func (c *cacheConn) ReadFrom([]byte) (n int, addr net.Addr, err error) {
@@ -61,62 +212,410 @@ func (c *cacheConn) ReadFrom([]byte) (n int, addr net.Addr, err error) {
 
 func (c *cacheConn) Write(b []byte) (n int, err error) {
 	// Parse the DNS request to see if we have a cached answer.
+	query := b
+	if c.stream {
+		query, err = unframeMsg(b)
+		if err != nil {
+			return 0, fmt.Errorf("unframe dns message to check cache: %w", err)
+		}
+	}
 	msg := &dnsmessage.Message{}
-	if err := msg.Unpack(b); err != nil {
+	if err := msg.Unpack(query); err != nil {
 		return 0, fmt.Errorf("unpack dns message to check cache: %w", err)
 	}
+	c.ctx, c.span = c.tracer.Start(c.ctx, "dns.cache.query")
+	c.span.SetAttribute(AttrUpstream, c.addr)
+	c.event = QueryEvent{Time: time.Now(), Server: c.addr}
 
 	// Only support a single question for simplicity.
 	if len(msg.Questions) != 1 {
-		c.realConn, err = c.dial()
-		if err != nil {
+		c.logger.DebugContext(c.ctx, "dns cache passthrough for query with multiple questions",
+			"questions", len(msg.Questions))
+		c.setResult("passthrough")
+		if err := c.dialRealConn(); err != nil {
 			return 0, fmt.Errorf("dial conn for dns cache with multiple questions: %w", err)
 		}
 		return c.realConn.Write(b)
 	}
 	q := msg.Questions[0]
+	c.qtype = q.Type
+	c.event.Question, c.event.Type = q.Name.String(), TypeLabel(q.Type)
+	c.span.SetAttribute(AttrQuestion, c.event.Question)
+	c.span.SetAttribute(AttrType, c.event.Type)
 
-	// Only support A and AAAA records for simplicity.
-	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
-		c.realConn, err = c.dial()
-		if err != nil {
+	if !isCacheableType(q.Type) {
+		c.logger.DebugContext(c.ctx, "dns cache passthrough for uncacheable type",
+			"question", q.Name.String(), "type", TypeLabel(q.Type))
+		c.setResult("passthrough")
+		if err := c.dialRealConn(); err != nil {
 			return 0, fmt.Errorf("dial conn for dns cache with unsupported type %s: %w", q.Type, err)
 		}
+		return c.realConn.Write(b)
 	}
 
-	answer, ok := c.questionCache.Get(newQuestion(q))
+	question := newQuestion(q, c.namespace)
+	answer, ok := c.questionCache.Get(question)
+	if !ok {
+		answer, ok = c.awaitFlight(question)
+	}
 	// Cache miss. Delegate to the real connection.
 	if !ok {
-		c.realConn, err = c.dial()
-		if err != nil {
+		c.stats.misses.Add(1)
+		c.observer.Miss(q.Type)
+		c.logger.DebugContext(c.ctx, "dns cache miss", "question", q.Name.String(), "type", TypeLabel(q.Type))
+		c.setResult("miss")
+		c.query = msg
+		if err := c.dialRealConn(); err != nil {
+			c.finishFlight(Answer{}, false)
+			if c.serveStale() {
+				return len(b), nil
+			}
 			return 0, fmt.Errorf("dial conn for dns cache on cache miss: %w", err)
 		}
-		return c.realConn.Write(b)
+		if c.randomizeCase {
+			if b, err = c.randomizeQueryCase(b); err != nil {
+				c.finishFlight(Answer{}, false)
+				return 0, fmt.Errorf("randomize case of dns query on cache miss: %w", err)
+			}
+		}
+		c.upstreamStart = time.Now()
+		n, err := c.realConn.Write(b)
+		if err != nil {
+			c.upstreamError("write", err)
+			if c.serveStale() {
+				return len(b), nil
+			}
+		}
+		return n, err
 	}
+	c.stats.hits.Add(1)
+	c.observer.Hit(q.Type)
+	c.logger.DebugContext(c.ctx, "dns cache hit", "question", q.Name.String(), "type", TypeLabel(q.Type),
+		"remaining_ttl", answer.RemainingTTL(), "coalesced", c.coalesced)
+	if c.coalesced {
+		c.setResult("coalesced")
+	} else {
+		c.setResult("hit")
+	}
+	c.setAnswer(answer, answer.RemainingTTL())
 
 	// Cache hit. Store the complete, packed DNS response for Read calls.
 	// The Go implementation of dnsPacketRoundTrip uses a single Write call.
-	msg.Answers, err = buildAnswers(q, answer)
+	if err := c.setCachedResp(msg, answer, nil); err != nil {
+		return 0, fmt.Errorf("build dns response on cache hit: %w", err)
+	}
+	if c.shouldPrefetch(answer) {
+		c.prefetch(q)
+	}
+	return len(b), nil
+}
+
+// randomizeQueryCase returns a copy of the query b with the case of the
+// question name randomized. Records the randomized name to verify the
+// response before caching it on Close.
+func (c *cacheConn) randomizeQueryCase(b []byte) ([]byte, error) {
+	b = slices.Clone(b)
+	msg := b
+	if c.stream {
+		msg = b[2:]
+	}
+	name, err := randomizeNameCase(msg)
+	if err != nil {
+		return nil, err
+	}
+	c.upstreamName = name
+	return b, nil
+}
+
+// shouldPrefetch returns true if the answer expires within the last
+// prefetchThreshold fraction of its TTL.
+func (c *cacheConn) shouldPrefetch(answer Answer) bool {
+	if c.prefetch == nil {
+		return false
+	}
+	return answer.RemainingTTL() < time.Duration(float64(answer.TTL)*c.prefetchThreshold)
+}
+
+// isCacheableType returns true if answers to questions of type t are cached.
+// Meta-query types, like ANY and zone transfers, are never cached.
+func isCacheableType(t dnsmessage.Type) bool {
+	//nolint:exhaustive
+	switch t {
+	case dnsmessage.TypeALL, dnsmessage.TypeAXFR, dnsmessage.TypeOPT:
+		return false
+	default:
+		return true
+	}
+}
+
+// setCachedResp builds the DNS response for the query msg from answer and
+// stores it for Read calls. The response has the header flags and EDNS0
+// parameters of the upstream response. If the query has an OPT record, the
+// response OPT record includes ednsOptions.
+func (c *cacheConn) setCachedResp(msg *dnsmessage.Message, answer Answer, ednsOptions []dnsmessage.Option) error {
+	if len(answer.Raw) > 0 {
+		return c.setRawCachedResp(msg, answer)
+	}
+
+	maxSize := maxPacketRespSize(msg)
+	var err error
+	msg.Answers, err = buildAnswers(msg.Questions[0], answer)
 	if err != nil {
-		return 0, fmt.Errorf("build answers for dns cache on cache hit: %w", err)
+		return fmt.Errorf("build answers: %w", err)
 	}
 	msg.Response = true
-	packed, err := msg.Pack()
+	msg.RCode = answer.RCode
+	msg.Authoritative = answer.Flags.Authoritative
+	msg.RecursionAvailable = answer.Flags.RecursionAvailable
+	msg.AuthenticData = answer.Flags.AuthenticData
+	msg.Truncated = false
+	msg.Authorities = buildAuthorities(answer)
+	msg.Additionals, err = buildAdditionals(msg.Additionals, answer.Flags, ednsOptions)
+	if err != nil {
+		return fmt.Errorf("build additionals: %w", err)
+	}
+	packed, err := msg.AppendPack(make([]byte, 2, 514))
 	if err != nil {
-		return 0, fmt.Errorf("pack dns message for dns cache on cache hit: %w", err)
+		return fmt.Errorf("pack dns message: %w", err)
+	}
+	if c.stream {
+		packed = frameMsg(packed)
+	} else if len(packed)-2 > maxSize {
+		// An answer cached from TCP may not fit in a UDP response. Set the TC
+		// bit so the Go resolver retries over TCP, which hits the cache.
+		msg.Truncated = true
+		msg.Answers = nil
+		msg.Authorities = nil
+		if packed, err = msg.Pack(); err != nil {
+			return fmt.Errorf("pack truncated dns message: %w", err)
+		}
+	} else {
+		packed = packed[2:]
 	}
 	c.cachedResp = bytes.NewReader(packed)
+	return nil
+}
 
-	return len(b), nil
+// maxPacketRespSize returns the maximum size of a UDP response to the query
+// msg. The size is the UDP payload size of the query's OPT record, or 512
+// bytes without one, per RFC 6891 section 6.2.5.
+func maxPacketRespSize(msg *dnsmessage.Message) int {
+	const minSize = 512
+	for _, r := range msg.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			return max(int(r.Header.Class), minSize)
+		}
+	}
+	return minSize
+}
+
+// buildAdditionals returns the additional section of a response to a query
+// with the given additional section. Replaces the OPT record of the query with
+// the server OPT record of the upstream response. Per RFC 6891 section 7, the
+// response has no OPT record if the query has none.
+func buildAdditionals(queryAdditionals []dnsmessage.Resource, flags ResponseFlags, ednsOptions []dnsmessage.Option) ([]dnsmessage.Resource, error) {
+	hasOPT := false
+	additionals := make([]dnsmessage.Resource, 0, len(queryAdditionals))
+	for _, r := range queryAdditionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			hasOPT = true
+			continue
+		}
+		additionals = append(additionals, r)
+	}
+	if !hasOPT || (!flags.EDNS0 && len(ednsOptions) == 0) {
+		return additionals, nil
+	}
+
+	udpSize := flags.UDPSize
+	if !flags.EDNS0 {
+		udpSize = maxUDPSize
+	}
+	var rh dnsmessage.ResourceHeader
+	if err := rh.SetEDNS0(int(udpSize), dnsmessage.RCodeSuccess, flags.DNSSECOK); err != nil {
+		return nil, fmt.Errorf("set edns0: %w", err)
+	}
+	return append(additionals, dnsmessage.Resource{
+		Header: rh,
+		Body:   &dnsmessage.OPTResource{Options: ednsOptions},
+	}), nil
+}
+
+// setRawCachedResp replays the packed upstream response in answer.Raw with
+// the ID of the query msg and remaining TTLs, and stores it for Read calls.
+func (c *cacheConn) setRawCachedResp(msg *dnsmessage.Message, answer Answer) error {
+	resp, err := rewriteRawResp(answer.Raw, msg.ID, answer.RemainingTTL())
+	if err != nil {
+		return fmt.Errorf("rewrite raw response: %w", err)
+	}
+	if c.stream {
+		resp = frameMsg(append(make([]byte, 2, 2+len(resp)), resp...))
+	} else if len(resp) > maxPacketRespSize(msg) {
+		if resp, err = truncateRawResp(resp); err != nil {
+			return fmt.Errorf("truncate raw response: %w", err)
+		}
+	}
+	c.cachedResp = bytes.NewReader(resp)
+	return nil
+}
+
+// truncateRawResp returns the packed DNS response resp with the TC bit set
+// and only the question and OPT record, so the Go resolver retries over TCP.
+func truncateRawResp(resp []byte) ([]byte, error) {
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("unpack dns message: %w", err)
+	}
+	msg.Truncated = true
+	msg.Answers = nil
+	msg.Authorities = nil
+	msg.Additionals = slices.DeleteFunc(msg.Additionals, func(r dnsmessage.Resource) bool {
+		return r.Header.Type != dnsmessage.TypeOPT
+	})
+	return msg.Pack()
+}
+
+// dialRealConn dials the real connection and applies deadlines set before
+// dialing.
+func (c *cacheConn) dialRealConn() error {
+	conn, err := c.dial(c.ctx)
+	if err != nil {
+		c.upstreamError("dial", err)
+		return err
+	}
+	c.realConn = conn
+	if !c.readDeadline.IsZero() {
+		if err := conn.SetReadDeadline(c.readDeadline); err != nil {
+			return fmt.Errorf("set read deadline: %w", err)
+		}
+	}
+	if !c.writeDeadline.IsZero() {
+		if err := conn.SetWriteDeadline(c.writeDeadline); err != nil {
+			return fmt.Errorf("set write deadline: %w", err)
+		}
+	}
+	return nil
+}
+
+// upstreamError records a failed query to the upstream DNS server. The op is
+// the failed operation, like "dial".
+func (c *cacheConn) upstreamError(op string, err error) {
+	c.stats.upstreamErrors.Add(1)
+	c.observer.UpstreamError(c.qtype)
+	c.logger.DebugContext(c.ctx, "dns cache upstream query failed", "op", op, "type", TypeLabel(c.qtype), "error", err)
+	err = fmt.Errorf("%s upstream dns server: %w", op, err)
+	c.span.RecordError(err)
+	c.event.Err = err
+}
+
+// serveStale stores a stale response for the query if the cache has an
+// expired answer within maxStale, per RFC 8767. Returns false if no stale
+// answer is available.
+//
+// The stale response includes an Extended DNS Error option with the
+// "Stale Answer" info code, per RFC 8914, if the query has an OPT record.
+func (c *cacheConn) serveStale() bool {
+	if c.maxStale <= 0 || c.query == nil {
+		return false
+	}
+	sc, ok := c.questionCache.(StaleQuestionCache)
+	if !ok {
+		return false
+	}
+	answer, ok := sc.GetStale(newQuestion(c.query.Questions[0], c.namespace))
+	expiredFor := -answer.RemainingTTL()
+	if !ok || expiredFor > c.maxStale {
+		return false
+	}
+	answer.FetchTime, answer.TTL = time.Now(), c.staleTTL
+
+	msg := *c.query
+	staleErr := dnsmessage.Option{
+		Code: ednsOptionExtendedError,
+		Data: []byte{0, edeStaleAnswer},
+	}
+	if err := c.setCachedResp(&msg, answer, []dnsmessage.Option{staleErr}); err != nil {
+		return false
+	}
+	c.stats.staleServes.Add(1)
+	c.setResult("stale")
+	c.setAnswer(answer, answer.TTL)
+	c.logger.DebugContext(c.ctx, "dns cache served stale answer", "question", c.query.Questions[0].Name.String(),
+		"type", TypeLabel(c.qtype), "expired_for", expiredFor)
+	return true
+}
+
+// awaitFlight coalesces a cache miss with concurrent cache misses for the same
+// question. If another conn is querying upstream, awaitFlight waits for its
+// answer. Otherwise, this conn leads a new flight and must query upstream.
+func (c *cacheConn) awaitFlight(q Question) (Answer, bool) {
+	if c.flights == nil {
+		return Answer{}, false
+	}
+	f, isLeader := c.flights.join(q)
+	if !isLeader {
+		c.coalesced = true
+		c.stats.coalescedWaits.Add(1)
+		return f.wait(c.ctx)
+	}
+	c.flight, c.flightQuestion = f, q
+	// Another flight might have filled the cache between the cache miss and
+	// starting this flight.
+	if a, ok := c.questionCache.Get(q); ok {
+		c.finishFlight(a, true)
+		return a, true
+	}
+	return Answer{}, false
+}
+
+// finishFlight completes the flight led by this conn, if any.
+func (c *cacheConn) finishFlight(a Answer, ok bool) {
+	if c.flight == nil {
+		return
+	}
+	c.flights.finish(c.flightQuestion, c.flight, a, ok)
+	c.flight = nil
 }
 
 func (c *cacheConn) WriteTo([]byte, net.Addr) (n int, err error) {
 	return 0, fmt.Errorf("cacheConn WriteTo not implemented")
 }
 
+// minResponseTTL is the minimum TTL of answers in responses built from the
+// cache. Avoids zero TTLs for answers about to expire, which downstream caches
+// would not cache at all.
+const minResponseTTL = time.Second
+
 // buildAnswers returns the DNS answers for a question from the cached Answer.
+// The answers start with the CNAME chain, if any, followed by the IP address
+// records for the canonical name and any other records. Every answer has the
+// remaining TTL of the Answer, which is clamped to MinTTL and MaxTTL, so all
+// records expire from downstream caches together.
 func buildAnswers(q dnsmessage.Question, answer Answer) ([]dnsmessage.Resource, error) {
-	answers := make([]dnsmessage.Resource, 0, len(answer.IPs))
+	ttl := responseTTL(answer.RemainingTTL())
+	answers := make([]dnsmessage.Resource, 0, len(answer.CNAMEs)+len(answer.IPs))
+	name := q.Name
+	for _, cname := range answer.CNAMEs {
+		alias, err := dnsmessage.NewName(cname.Name)
+		if err != nil {
+			return nil, fmt.Errorf("cached CNAME name %q: %w", cname.Name, err)
+		}
+		target, err := dnsmessage.NewName(cname.Target)
+		if err != nil {
+			return nil, fmt.Errorf("cached CNAME target %q: %w", cname.Target, err)
+		}
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  alias,
+				Type:  dnsmessage.TypeCNAME,
+				Class: q.Class,
+				TTL:   ttl,
+			},
+			Body: &dnsmessage.CNAMEResource{CNAME: target},
+		})
+		name = target
+	}
+
 	for _, ip := range answer.IPs {
 		// The cached IP address must match the requested type since the cache key,
 		// a Question, includes the type.
@@ -129,10 +628,10 @@ func buildAnswers(q dnsmessage.Question, answer Answer) ([]dnsmessage.Resource,
 
 		resource := dnsmessage.Resource{
 			Header: dnsmessage.ResourceHeader{
-				Name:  q.Name,
+				Name:  name,
 				Type:  q.Type,
 				Class: q.Class,
-				TTL:   uint32(answer.TTL / time.Second), //nolint:gosec
+				TTL:   ttl,
 			},
 		}
 		switch {
@@ -146,47 +645,261 @@ func buildAnswers(q dnsmessage.Question, answer Answer) ([]dnsmessage.Resource,
 		answers = append(answers, resource)
 	}
 
+	for _, r := range answer.Records {
+		r.Header.TTL = ttl
+		answers = append(answers, r)
+	}
+
 	return answers, nil
 }
 
+// buildAuthorities returns the authority section of a response built from the
+// cached Answer. Negative answers include the SOA record with the remaining
+// TTL of the Answer so downstream caches can cache the negative answer, per
+// RFC 2308 section 3.
+func buildAuthorities(answer Answer) []dnsmessage.Resource {
+	if answer.SOA == nil {
+		return nil
+	}
+	soa := *answer.SOA
+	soa.Header.TTL = responseTTL(answer.RemainingTTL())
+	return []dnsmessage.Resource{soa}
+}
+
+// responseTTL returns the TTL in seconds for a record in a response built from
+// the cache, with a floor of minResponseTTL.
+func responseTTL(remaining time.Duration) uint32 {
+	return uint32(max(remaining, minResponseTTL) / time.Second) //nolint:gosec
+}
+
 func (c *cacheConn) Close() (mErr error) {
-	// Cache hit, nothing to do.
+	defer func() { c.endQuery(mErr) }()
+
+	// Cache hit, or dialing the real connection failed. Finish the flight, if
+	// any, so later cache misses don't wait for a query that was never sent.
 	if c.realConn == nil {
+		c.finishFlight(Answer{}, false)
 		return nil
 	}
 
 	// Always close the conn.
 	defer capture(&mErr, c.realConn.Close, "close real conn")
 
-	// Cache miss, but we didn't get response. Network error?
-	if len(c.realResp) == 0 {
-		return nil
+	if c.cachedResp == nil {
+		if rcode, ok := c.realRespRCode(); ok {
+			c.span.SetAttribute(AttrRCode, rcode.String())
+			c.event.RCode = rcode.String()
+		}
+	}
+
+	answer, ok, err := c.storeResp()
+	if ok {
+		c.event.IPs, c.event.TTL = answer.IPs, answer.TTL
+	}
+	c.finishFlight(answer, ok)
+	return err
+}
+
+// setResult records how the query was answered. See AttrCacheResult.
+func (c *cacheConn) setResult(result string) {
+	c.span.SetAttribute(AttrCacheResult, result)
+	c.event.Source = result
+}
+
+// setAnswer records the answer served from the cache with the ttl in the
+// response.
+func (c *cacheConn) setAnswer(answer Answer, ttl time.Duration) {
+	c.span.SetAttribute(AttrRCode, answer.RCode.String())
+	c.event.RCode = answer.RCode.String()
+	c.event.IPs, c.event.TTL = answer.IPs, ttl
+}
+
+// endQuery ends the span and logs the query event, if the conn answered a
+// query from the resolver. The err is the error from Close.
+func (c *cacheConn) endQuery(err error) {
+	c.span.End()
+	if c.event.Time.IsZero() {
+		return
+	}
+	if c.event.Err == nil {
+		c.event.Err = err
+	}
+	c.event.Latency = time.Since(c.event.Time)
+	c.queryLog.LogQuery(c.event)
+}
+
+// realRespRCode returns the response code of the response from the real
+// connection. Returns false if there's no valid response.
+func (c *cacheConn) realRespRCode() (dnsmessage.RCode, bool) {
+	resp := c.realResp
+	if c.stream {
+		var err error
+		if resp, err = unframeMsg(resp); err != nil {
+			return 0, false
+		}
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return 0, false
+	}
+	return h.RCode, true
+}
+
+// storeResp stores the response from the real connection in the cache.
+// Returns the stored answer and true if the response was cached.
+func (c *cacheConn) storeResp() (Answer, bool, error) {
+	// Cache miss, but we didn't get response. Network error? Or the query
+	// wasn't cacheable, like a query with multiple questions.
+	if len(c.realResp) == 0 || c.query == nil {
+		return Answer{}, false, nil
 	}
 
 	// Cache miss. Store the response in the cache.
+	resp := c.realResp
+	if c.stream {
+		var err error
+		resp, err = unframeMsg(resp)
+		if err != nil {
+			return Answer{}, false, fmt.Errorf("unframe response to cache on close: %w", err)
+		}
+	}
 	msg := &dnsmessage.Message{}
-	if err := msg.Unpack(c.realResp); err != nil {
-		return fmt.Errorf("unpack response to cache on close: %w", err)
+	if err := msg.Unpack(resp); err != nil {
+		c.stats.rejected.Add(1)
+		c.logger.DebugContext(c.ctx, "dns cache rejected upstream response", "type", TypeLabel(c.qtype), "error", err)
+		return Answer{}, false, fmt.Errorf("unpack response to cache on close: %w", err)
 	}
 
-	// Only support a single question for simplicity.
-	if len(msg.Questions) != 1 {
-		return nil
+	if err := c.validateResp(msg); err != nil {
+		c.stats.rejected.Add(1)
+		c.logger.DebugContext(c.ctx, "dns cache rejected upstream response", "type", TypeLabel(c.qtype), "error", err)
+		return Answer{}, false, fmt.Errorf("reject response to cache on close: %w", err)
+	}
+
+	// A truncated response is incomplete. The Go resolver retries truncated
+	// UDP responses over TCP, which caches the complete response.
+	if msg.Truncated {
+		return Answer{}, false, nil
 	}
 
 	// Store the response in the cache.
-	question := newQuestion(msg.Questions[0])
+	question := newQuestion(msg.Questions[0], c.namespace)
 	answer, err := newAnswer(msg)
+	if errors.Is(err, errUncacheable) {
+		return Answer{}, false, nil
+	}
 	if err != nil {
-		return fmt.Errorf("build new answer to cache on close: %w", err)
+		return Answer{}, false, fmt.Errorf("build new answer to cache on close: %w", err)
+	}
+	answer.TTL = c.clampTTL(answer.TTL)
+	if c.rawResponses {
+		answer.Raw = resp
+	}
+	if answer.IsExpired() {
+		return Answer{}, false, nil
+	}
+	c.questionCache.Set(question, answer)
+	c.observer.Fill(question.Type)
+	c.logger.DebugContext(c.ctx, "dns cache fill", "question", question.FQDN, "type", TypeLabel(question.Type),
+		"rcode", answer.RCode.String(), "ttl", answer.TTL, "ips", len(answer.IPs))
+	return answer, true, nil
+}
+
+// validateResp returns an error if the upstream response msg doesn't answer
+// the query. Guards the cache against malformed or spoofed responses, which
+// would otherwise be served for the full TTL.
+func (c *cacheConn) validateResp(msg *dnsmessage.Message) error {
+	if !msg.Response {
+		return errors.New("message is not a response")
+	}
+	if msg.ID != c.query.ID {
+		return fmt.Errorf("response id %d does not match query id %d", msg.ID, c.query.ID)
 	}
-	if !answer.IsExpired() {
-		c.questionCache.Set(question, answer)
+	if len(msg.Questions) != 1 {
+		return fmt.Errorf("response has %d questions; want 1", len(msg.Questions))
+	}
+	got, want := msg.Questions[0], c.query.Questions[0]
+	if got.Type != want.Type || got.Class != want.Class ||
+		canonicalName(got.Name.String()) != canonicalName(want.Name.String()) {
+		return fmt.Errorf("response question %s %s %s does not match query question %s %s %s",
+			got.Name, got.Class, got.Type, want.Name, want.Class, want.Type)
+	}
+	// With case randomization, a response that doesn't echo the exact question
+	// name may be spoofed.
+	if c.upstreamName != "" && got.Name.String() != c.upstreamName {
+		return fmt.Errorf("response question name %s does not match randomized name %s", got.Name, c.upstreamName)
 	}
 
+	// Answer records must be owned by the question name or a name in its CNAME
+	// chain. CNAME records may be in any order.
+	names := map[string]bool{canonicalName(got.Name.String()): true}
+	for grew := true; grew; {
+		grew = false
+		for _, r := range msg.Answers {
+			cname, ok := r.Body.(*dnsmessage.CNAMEResource)
+			if !ok || !names[canonicalName(r.Header.Name.String())] {
+				continue
+			}
+			if target := canonicalName(cname.CNAME.String()); !names[target] {
+				names[target] = true
+				grew = true
+			}
+		}
+	}
+	// A DNAME record, per RFC 6672, is owned by an ancestor of a name in the
+	// chain and accompanies the CNAME record synthesized from it.
+	dnameOwners := make(map[string]bool)
+	for _, r := range msg.Answers {
+		if r.Header.Type != typeDNAME {
+			continue
+		}
+		owner := canonicalName(r.Header.Name.String())
+		for name := range names {
+			if name != owner && hasNameSuffix(name, owner) {
+				dnameOwners[owner] = true
+				break
+			}
+		}
+	}
+	for _, r := range msg.Answers {
+		owner := canonicalName(r.Header.Name.String())
+		isDNAME := dnameOwners[owner] && (r.Header.Type == typeDNAME || r.Header.Type == typeRRSIG)
+		if !names[owner] && !isDNAME {
+			return fmt.Errorf("answer %s record owner %s unrelated to question %s", r.Header.Type, r.Header.Name, got.Name)
+		}
+		// Answer records must have the question type and class. Otherwise, an
+		// AAAA record could be cached as the answer to an A question. DNSSEC
+		// signatures accompany the records they sign.
+		if r.Header.Type != got.Type && r.Header.Type != dnsmessage.TypeCNAME &&
+			r.Header.Type != typeDNAME && r.Header.Type != typeRRSIG {
+			return fmt.Errorf("answer %s record for %s does not match question type %s", r.Header.Type, r.Header.Name, got.Type)
+		}
+		if r.Header.Class != got.Class {
+			return fmt.Errorf("answer %s record for %s has class %s; want question class %s", r.Header.Type, r.Header.Name, r.Header.Class, got.Class)
+		}
+	}
 	return nil
 }
 
+const (
+	// typeDNAME is the delegation name record type, per RFC 6672.
+	typeDNAME dnsmessage.Type = 39
+	// typeRRSIG is the DNSSEC signature record type, per RFC 4034.
+	typeRRSIG dnsmessage.Type = 46
+)
+
+// clampTTL returns ttl clamped to minTTL and maxTTL.
+func (c *cacheConn) clampTTL(ttl time.Duration) time.Duration {
+	if c.minTTL > 0 {
+		ttl = max(ttl, c.minTTL)
+	}
+	if c.maxTTL > 0 {
+		ttl = min(ttl, c.maxTTL)
+	}
+	return ttl
+}
+
 func (c *cacheConn) LocalAddr() net.Addr {
 	if c.realConn == nil {
 		return nil
@@ -203,6 +916,7 @@ func (c *cacheConn) RemoteAddr() net.Addr {
 
 func (c *cacheConn) SetDeadline(t time.Time) error {
 	if c.realConn == nil {
+		c.readDeadline, c.writeDeadline = t, t
 		return nil
 	}
 	return c.realConn.SetDeadline(t)
@@ -210,6 +924,7 @@ func (c *cacheConn) SetDeadline(t time.Time) error {
 
 func (c *cacheConn) SetReadDeadline(t time.Time) error {
 	if c.realConn == nil {
+		c.readDeadline = t
 		return nil
 	}
 	return c.realConn.SetReadDeadline(t)
@@ -217,11 +932,34 @@ func (c *cacheConn) SetReadDeadline(t time.Time) error {
 
 func (c *cacheConn) SetWriteDeadline(t time.Time) error {
 	if c.realConn == nil {
+		c.writeDeadline = t
 		return nil
 	}
 	return c.realConn.SetWriteDeadline(t)
 }
 
+// frameMsg sets the 2-byte length prefix of a DNS message for stream
+// transports, per RFC 7766 section 8. The first 2 bytes of b are reserved for
+// the length prefix.
+func frameMsg(b []byte) []byte {
+	l := len(b) - 2
+	b[0] = byte(l >> 8)
+	b[1] = byte(l)
+	return b
+}
+
+// unframeMsg returns the DNS message from a length-prefixed stream message.
+func unframeMsg(b []byte) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("stream dns message missing 2-byte length prefix")
+	}
+	l := int(b[0])<<8 | int(b[1])
+	if len(b)-2 < l {
+		return nil, fmt.Errorf("stream dns message has length %d but only %d bytes", l, len(b)-2)
+	}
+	return b[2 : 2+l], nil
+}
+
 // capture runs errFunc and assigns the error, if any, to *errPtr.
 // Preserves the original error by wrapping with errors.Join if
 // errFunc returns a non-nil error.
@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"expvar"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ Observer = (*ExpvarObserver)(nil)
+
+// ExpvarObserver is an Observer that records events in an expvar.Map. The map
+// has a nested map for each event, keyed by question type:
+//
+//	{
+//		"hits": {"A": 12, "AAAA": 10},
+//		"misses": {"A": 2, "AAAA": 2},
+//		"fills": {"A": 2, "AAAA": 2},
+//		"evictions": {},
+//		"upstream_errors": {},
+//		"upstream_responses": {"A": 2, "AAAA": 2},
+//		"upstream_seconds": {"A": 0.018, "AAAA": 0.021}
+//	}
+//
+// The upstream_seconds map is the total upstream latency. Divide by
+// upstream_responses for the mean latency.
+type ExpvarObserver struct {
+	hits              *expvar.Map
+	misses            *expvar.Map
+	fills             *expvar.Map
+	evictions         *expvar.Map
+	upstreamErrors    *expvar.Map
+	upstreamResponses *expvar.Map
+	upstreamSeconds   *expvar.Map
+}
+
+// NewExpvarObserver returns an ExpvarObserver that records events in m. To
+// publish the events, create m with expvar.NewMap, like:
+//
+//	cache := &dns.Cache{
+//		Observer: dns.NewExpvarObserver(expvar.NewMap("dns_cache")),
+//	}
+func NewExpvarObserver(m *expvar.Map) *ExpvarObserver {
+	newMap := func(key string) *expvar.Map {
+		nested := new(expvar.Map)
+		m.Set(key, nested)
+		return nested
+	}
+	return &ExpvarObserver{
+		hits:              newMap("hits"),
+		misses:            newMap("misses"),
+		fills:             newMap("fills"),
+		evictions:         newMap("evictions"),
+		upstreamErrors:    newMap("upstream_errors"),
+		upstreamResponses: newMap("upstream_responses"),
+		upstreamSeconds:   newMap("upstream_seconds"),
+	}
+}
+
+func (o *ExpvarObserver) Hit(typ dnsmessage.Type)   { o.hits.Add(TypeLabel(typ), 1) }
+func (o *ExpvarObserver) Miss(typ dnsmessage.Type)  { o.misses.Add(TypeLabel(typ), 1) }
+func (o *ExpvarObserver) Fill(typ dnsmessage.Type)  { o.fills.Add(TypeLabel(typ), 1) }
+func (o *ExpvarObserver) Evict(typ dnsmessage.Type) { o.evictions.Add(TypeLabel(typ), 1) }
+
+func (o *ExpvarObserver) UpstreamLatency(typ dnsmessage.Type, d time.Duration) {
+	label := TypeLabel(typ)
+	o.upstreamResponses.Add(label, 1)
+	o.upstreamSeconds.AddFloat(label, d.Seconds())
+}
+
+func (o *ExpvarObserver) UpstreamError(typ dnsmessage.Type) {
+	o.upstreamErrors.Add(TypeLabel(typ), 1)
+}
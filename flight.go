@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent cache misses for the same Question so that
+// only one conn queries the upstream DNS server. The zero value is ready to
+// use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[Question]*flight
+}
+
+// flight is an in-progress upstream query for a Question.
+type flight struct {
+	// done is closed when the upstream query finishes.
+	done chan struct{}
+	// answer is the answer from the upstream query. Only valid if ok is true.
+	// Written before done is closed.
+	answer Answer
+	ok     bool
+}
+
+// join returns the in-progress flight for q. If no flight exists, join starts
+// a new flight and returns isLeader true. The leader must call finish.
+func (g *flightGroup) join(q Question) (f *flight, isLeader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[q]; ok {
+		return f, false
+	}
+	if g.flights == nil {
+		g.flights = make(map[Question]*flight)
+	}
+	f = &flight{done: make(chan struct{})}
+	g.flights[q] = f
+	return f, true
+}
+
+// finish completes the flight for q and wakes all waiters. If ok is false,
+// the upstream query failed and waiters must query upstream themselves.
+func (g *flightGroup) finish(q Question, f *flight, a Answer, ok bool) {
+	g.mu.Lock()
+	delete(g.flights, q)
+	g.mu.Unlock()
+	f.answer, f.ok = a, ok
+	close(f.done)
+}
+
+// wait blocks until the flight finishes or ctx is done.
+func (f *flight) wait(ctx context.Context) (Answer, bool) {
+	select {
+	case <-f.done:
+		return f.answer, f.ok
+	case <-ctx.Done():
+		return Answer{}, false
+	}
+}
@@ -0,0 +1,211 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultResolvConfPath is the path of the system DNS resolver configuration.
+const defaultResolvConfPath = "/etc/resolv.conf"
+
+// defaultTimeout and defaultAttempts are the per-query timeout and the number
+// of attempts for each nameserver when /etc/resolv.conf doesn't set them,
+// matching the Go resolver.
+const (
+	defaultTimeout  = 5 * time.Second
+	defaultAttempts = 2
+)
+
+// lookup queries the cache for name and typ, querying the upstream DNS server
+// on a cache miss. Used for record types the Go resolver can't look up, like
+// HTTPS.
+//
+// Like the Go resolver, lookup tries each nameserver from /etc/resolv.conf in
+// order, up to the configured number of attempts, and retries over TCP if the
+// UDP response is truncated. Each query times out after the configured
+// timeout, even if ctx has no deadline.
+func (c *Cache) lookup(ctx context.Context, name string, typ dnsmessage.Type) (*dnsmessage.Message, error) {
+	c.init()
+	fqdn := name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	dnsName, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns name %q: %w", name, err)
+	}
+	q := dnsmessage.Question{Name: dnsName, Type: typ, Class: dnsmessage.ClassINET}
+
+	conf := readResolvConf(c.resolvConfPath)
+	var errs []error
+attempts:
+	for range conf.attempts {
+		for _, server := range conf.servers {
+			for _, network := range []string{"udp", "tcp"} {
+				msg, err := c.exchangeWithTimeout(ctx, network, server, q, conf.timeout)
+				if err != nil {
+					errs = append(errs, err)
+					// Stop retrying once the caller's context is done.
+					if ctx.Err() != nil {
+						break attempts
+					}
+					break
+				}
+				if msg.Truncated && network == "udp" {
+					continue
+				}
+				if msg.RCode == dnsmessage.RCodeNameError {
+					return nil, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+				}
+				if msg.RCode != dnsmessage.RCodeSuccess {
+					errs = append(errs, fmt.Errorf("dns server %s responded with rcode %s", server, msg.RCode))
+					break
+				}
+				return msg, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("lookup %s %s: %w", TypeLabel(typ), name, errors.Join(errs...))
+}
+
+// exchangeWithTimeout is exchange with a deadline of at most timeout.
+func (c *Cache) exchangeWithTimeout(ctx context.Context, network, server string, q dnsmessage.Question, timeout time.Duration) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return c.exchange(ctx, network, server, q)
+}
+
+// exchange sends a query for q to the server over a conn from the cache and
+// returns the response.
+func (c *Cache) exchange(ctx context.Context, network, server string, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	conn, err := c.dial(ctx, network, server)
+	if err != nil {
+		return nil, fmt.Errorf("dial dns server %s: %w", server, err)
+	}
+	defer func() {
+		// Close fails if the cache rejects the response, like a response that
+		// doesn't preserve the randomized case of the question name. The
+		// response is still valid for this lookup, so only log the error.
+		if err := conn.Close(); err != nil {
+			c.Logger.DebugContext(ctx, "dns cache close lookup conn", "server", server, "error", err)
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("set deadline: %w", err)
+		}
+	}
+
+	query, err := newQuery(q)
+	if err != nil {
+		return nil, fmt.Errorf("build query: %w", err)
+	}
+	id := uint16(query[2])<<8 | uint16(query[3])
+	_, isPacket := conn.(net.PacketConn)
+	if isPacket {
+		query = query[2:]
+	} else {
+		query = frameMsg(query)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("write query: %w", err)
+	}
+
+	var resp []byte
+	if isPacket {
+		b := make([]byte, maxUDPSize)
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, fmt.Errorf("read response: %w", err)
+		}
+		resp = b[:n]
+	} else {
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			return nil, fmt.Errorf("read response: %w", err)
+		}
+		resp, err = unframeMsg(b)
+		if err != nil {
+			return nil, fmt.Errorf("unframe response: %w", err)
+		}
+	}
+
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("unpack response: %w", err)
+	}
+	if msg.ID != id {
+		return nil, fmt.Errorf("response id %d does not match query id %d", msg.ID, id)
+	}
+	if len(msg.Questions) != 1 || msg.Questions[0].Type != q.Type ||
+		!strings.EqualFold(msg.Questions[0].Name.String(), q.Name.String()) {
+		return nil, fmt.Errorf("response question %v does not match query %v", msg.Questions, q)
+	}
+	return msg, nil
+}
+
+// resolvConf is the configuration from /etc/resolv.conf used by lookup.
+type resolvConf struct {
+	// servers are the nameserver addresses.
+	servers []string
+	// timeout is the timeout of each query, from "options timeout:n".
+	timeout time.Duration
+	// attempts is the number of times to try each nameserver, from
+	// "options attempts:n".
+	attempts int
+}
+
+// readResolvConf returns the nameservers and the timeout and attempts options
+// from the resolv.conf at path. Defaults to the local host if there are no
+// nameservers, like the Go resolver. Other options and directives, like
+// search domains, are ignored.
+func readResolvConf(path string) resolvConf {
+	conf := resolvConf{timeout: defaultTimeout, attempts: defaultAttempts}
+	if f, err := os.Open(path); err == nil {
+		conf.parse(f)
+		_ = f.Close()
+	}
+	if len(conf.servers) == 0 {
+		conf.servers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return conf
+}
+
+// parse reads the nameservers and options from the resolv.conf in r.
+func (conf *resolvConf) parse(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if ip, err := netip.ParseAddr(fields[1]); err == nil {
+				conf.servers = append(conf.servers, netip.AddrPortFrom(ip, 53).String())
+			}
+		case "options":
+			for _, opt := range fields[1:] {
+				// Like the Go resolver, values less than 1 are treated as 1.
+				if v, ok := strings.CutPrefix(opt, "timeout:"); ok {
+					n, _ := strconv.Atoi(v)
+					conf.timeout = time.Duration(max(n, 1)) * time.Second
+				} else if v, ok := strings.CutPrefix(opt, "attempts:"); ok {
+					n, _ := strconv.Atoi(v)
+					conf.attempts = max(n, 1)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache_LookupRetry(t *testing.T) {
+	host := "test-cache-lookup-retry.example.com."
+	_, fakeDNS := startServers(t, strings.TrimSuffix(host, "."))
+
+	// The first UDP query is lost. The lookup must time out and retry rather
+	// than wait forever, even though the context has no deadline.
+	lost := &lostPacketConn{}
+	var dialed []string
+	cache := &Cache{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+" "+addr)
+			if len(dialed) == 1 {
+				return lost, nil
+			}
+			return fakeDNS.DialContext(ctx, network, addr)
+		},
+		resolvConfPath: writeResolvConf(t, "nameserver 192.0.2.53\noptions timeout:3 attempts:2\n"),
+	}
+	start := time.Now()
+	got, err := cache.LookupHTTPS(context.Background(), host)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("LookupHTTPS: got %v, %v; want no bindings and no error", got, err)
+	}
+	if d := lost.readDeadline; !d.After(start) || d.After(time.Now().Add(3*time.Second)) {
+		t.Errorf("lost query read deadline: got %s after start; want within timeout 3s", d.Sub(start))
+	}
+	wantDialed := []string{"udp 192.0.2.53:53", "udp 192.0.2.53:53"}
+	if !reflect.DeepEqual(dialed, wantDialed) {
+		t.Errorf("dialed: got %v; want %v", dialed, wantDialed)
+	}
+}
+
+func TestReadResolvConf(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want resolvConf
+	}{
+		{
+			name: "defaults",
+			conf: "search example.com\n",
+			want: resolvConf{
+				servers:  []string{"127.0.0.1:53", "[::1]:53"},
+				timeout:  defaultTimeout,
+				attempts: defaultAttempts,
+			},
+		},
+		{
+			name: "options",
+			conf: "nameserver 10.0.0.53\nnameserver 2001:db8::53\noptions ndots:5 timeout:1 attempts:3\n",
+			want: resolvConf{
+				servers:  []string{"10.0.0.53:53", "[2001:db8::53]:53"},
+				timeout:  time.Second,
+				attempts: 3,
+			},
+		},
+		{
+			name: "options less than 1",
+			conf: "nameserver 10.0.0.53\noptions timeout:0 attempts:0\n",
+			want: resolvConf{
+				servers:  []string{"10.0.0.53:53"},
+				timeout:  time.Second,
+				attempts: 1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readResolvConf(writeResolvConf(t, tt.conf)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readResolvConf mismatch\nwant: %+v\ngot:  %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// writeResolvConf writes conf to a resolv.conf file for the test and returns
+// its path.
+func writeResolvConf(t *testing.T, conf string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatalf("write resolv.conf: %v", err)
+	}
+	return path
+}
+
+// lostPacketConn is a UDP conn that never receives a response. Read fails
+// immediately as if the read deadline passed, or fails with an error if
+// there's no read deadline, which would block forever.
+type lostPacketConn struct {
+	net.Conn
+	readDeadline time.Time
+}
+
+func (c *lostPacketConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func (c *lostPacketConn) Read([]byte) (int, error) {
+	if c.readDeadline.IsZero() {
+		return 0, errors.New("read without a deadline would block forever")
+	}
+	return 0, os.ErrDeadlineExceeded
+}
+
+func (c *lostPacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline = t
+	return nil
+}
+
+func (c *lostPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return nil
+}
+
+func (c *lostPacketConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *lostPacketConn) Close() error                     { return nil }
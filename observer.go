@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Observer receives events from a Cache, typically to record metrics. Each
+// event is labelled with the type of the question.
+//
+// Methods are called synchronously while answering a query, so they must be
+// safe for concurrent use and return quickly.
+type Observer interface {
+	// Hit is called when a query is answered from the cache, including by
+	// waiting for another query's upstream response.
+	Hit(typ dnsmessage.Type)
+	// Miss is called when a query is sent to the upstream DNS server.
+	Miss(typ dnsmessage.Type)
+	// Fill is called when an upstream answer is stored in the cache.
+	Fill(typ dnsmessage.Type)
+	// Evict is called when an answer is evicted from the default, in-memory
+	// cache to stay within MaxEntries.
+	Evict(typ dnsmessage.Type)
+	// UpstreamLatency is called with the time from sending a query to the
+	// upstream DNS server until reading its response.
+	UpstreamLatency(typ dnsmessage.Type, d time.Duration)
+	// UpstreamError is called when dialing, writing to, or reading from the
+	// upstream DNS server fails, or the server responds with SERVFAIL.
+	UpstreamError(typ dnsmessage.Type)
+}
+
+// nopObserver is an Observer that ignores all events.
+type nopObserver struct{}
+
+func (nopObserver) Hit(dnsmessage.Type)                            {}
+func (nopObserver) Miss(dnsmessage.Type)                           {}
+func (nopObserver) Fill(dnsmessage.Type)                           {}
+func (nopObserver) Evict(dnsmessage.Type)                          {}
+func (nopObserver) UpstreamLatency(dnsmessage.Type, time.Duration) {}
+func (nopObserver) UpstreamError(dnsmessage.Type)                  {}
+
+// TypeLabel returns the mnemonic of typ for use as a metric label, like "A"
+// or "HTTPS". Types without a mnemonic use the generic "TYPE65534" form, per
+// RFC 3597 section 5.
+func TypeLabel(typ dnsmessage.Type) string {
+	//nolint:exhaustive
+	switch typ {
+	case typeSVCB:
+		return "SVCB"
+	case typeHTTPS:
+		return "HTTPS"
+	}
+	if s, ok := strings.CutPrefix(typ.String(), "Type"); ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(typ))
+}
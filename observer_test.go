@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCache_Observer(t *testing.T) {
+	host := "test-cache-observer.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+	handler := fakeDNS.handler
+	observer := &recordingObserver{}
+	cache := &Cache{
+		Dial:       fakeDNS.DialContext,
+		MaxEntries: 1,
+		Observer:   observer,
+	}
+	cache.init()
+	exchange := func(name string, typ dnsmessage.Type) {
+		t.Helper()
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}
+		_, _ = cache.exchange(t.Context(), "udp", "127.0.0.1:53", q)
+	}
+
+	exchange(host, dnsmessage.TypeA)
+	exchange(host, dnsmessage.TypeA)
+	exchange(host, dnsmessage.TypeAAAA) // NODATA evicts the A answer
+	fakeDNS.handler = func(string, dnsmessage.Message) (dnsmessage.Message, error) {
+		return dnsmessage.Message{}, fmt.Errorf("upstream unavailable")
+	}
+	exchange(host, typeHTTPS)
+	fakeDNS.handler = handler
+
+	want := []string{
+		"miss A", "latency A", "fill A",
+		"hit A",
+		"miss AAAA", "latency AAAA", "evict A", "fill AAAA",
+		"miss HTTPS", "error HTTPS",
+	}
+	if got := observer.events(); !slices.Equal(got, want) {
+		t.Errorf("events mismatch\nwant: %v\ngot:  %v", want, got)
+	}
+}
+
+func TestExpvarObserver(t *testing.T) {
+	m := new(expvar.Map)
+	o := NewExpvarObserver(m)
+	o.Hit(dnsmessage.TypeA)
+	o.Hit(dnsmessage.TypeA)
+	o.Miss(dnsmessage.TypeAAAA)
+	o.UpstreamLatency(dnsmessage.TypeAAAA, 250*time.Millisecond)
+
+	want := `{"evictions": {}, "fills": {}, "hits": {"A": 2}, "misses": {"AAAA": 1}, ` +
+		`"upstream_errors": {}, "upstream_responses": {"AAAA": 1}, "upstream_seconds": {"AAAA": 0.25}}`
+	if got := m.String(); got != want {
+		t.Errorf("expvar mismatch\nwant: %s\ngot:  %s", want, got)
+	}
+}
+
+func TestPrometheusObserver_ServeHTTP(t *testing.T) {
+	o := NewPrometheusObserver()
+	o.Hit(dnsmessage.TypeAAAA)
+	o.Hit(dnsmessage.TypeA)
+	o.Hit(dnsmessage.TypeA)
+	o.Miss(typeHTTPS)
+	o.UpstreamError(dnsmessage.Type(65280))
+	o.UpstreamLatency(dnsmessage.TypeA, 20*time.Millisecond)
+	o.UpstreamLatency(dnsmessage.TypeA, 10*time.Second)
+
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("Content-Type: got %q; want %q", got, want)
+	}
+	got := w.Body.String()
+	for _, want := range []string{
+		"# TYPE dns_cache_hits_total counter\n" +
+			`dns_cache_hits_total{type="A"} 2` + "\n" +
+			`dns_cache_hits_total{type="AAAA"} 1` + "\n",
+		`dns_cache_misses_total{type="HTTPS"} 1` + "\n",
+		"# TYPE dns_cache_fills_total counter\n# HELP dns_cache_evictions_total",
+		`dns_cache_upstream_errors_total{type="TYPE65280"} 1` + "\n",
+		"# TYPE dns_cache_upstream_latency_seconds histogram\n",
+		`dns_cache_upstream_latency_seconds_bucket{type="A",le="0.01"} 0` + "\n" +
+			`dns_cache_upstream_latency_seconds_bucket{type="A",le="0.025"} 1` + "\n",
+		`dns_cache_upstream_latency_seconds_bucket{type="A",le="5"} 1` + "\n" +
+			`dns_cache_upstream_latency_seconds_bucket{type="A",le="+Inf"} 2` + "\n" +
+			`dns_cache_upstream_latency_seconds_sum{type="A"} 10.02` + "\n" +
+			`dns_cache_upstream_latency_seconds_count{type="A"} 2` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics missing:\n%s\ngot:\n%s", want, got)
+		}
+	}
+}
+
+// recordingObserver is an Observer that records events as strings, like
+// "hit A".
+type recordingObserver struct {
+	mu   sync.Mutex
+	evts []string
+}
+
+func (o *recordingObserver) record(event string, typ dnsmessage.Type) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.evts = append(o.evts, event+" "+TypeLabel(typ))
+}
+
+func (o *recordingObserver) events() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Clone(o.evts)
+}
+
+func (o *recordingObserver) Hit(typ dnsmessage.Type)   { o.record("hit", typ) }
+func (o *recordingObserver) Miss(typ dnsmessage.Type)  { o.record("miss", typ) }
+func (o *recordingObserver) Fill(typ dnsmessage.Type)  { o.record("fill", typ) }
+func (o *recordingObserver) Evict(typ dnsmessage.Type) { o.record("evict", typ) }
+
+func (o *recordingObserver) UpstreamLatency(typ dnsmessage.Type, _ time.Duration) {
+	o.record("latency", typ)
+}
+
+func (o *recordingObserver) UpstreamError(typ dnsmessage.Type) { o.record("error", typ) }
@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// prefetchTimeout bounds an upstream query to refresh an answer. Matches the
+// default timeout of the Go resolver.
+const prefetchTimeout = 5 * time.Second
+
+// prefetch asynchronously refreshes the answer for q by querying the upstream
+// DNS server at addr. Does nothing if an upstream query for q is already in
+// progress or the Cache is closed.
+func (c *Cache) prefetch(network, addr string, q dnsmessage.Question) {
+	question := newQuestion(q, c.namespace(addr))
+	f, isLeader := c.flights.join(question)
+	if !isLeader {
+		return
+	}
+	ok := c.goBackground(func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, prefetchTimeout)
+		defer cancel()
+		conn := c.newConn(ctx, network, addr)
+		conn.flight, conn.flightQuestion = f, question
+		// The answer is still fresh and no client waits for the response, so
+		// never serve it stale if the refresh fails.
+		conn.maxStale = 0
+		// Errors are not actionable. The answer expires as usual.
+		_ = refresh(ctx, conn, q)
+	})
+	if !ok {
+		c.flights.finish(question, f, Answer{}, false)
+	}
+}
+
+// refresh queries the upstream DNS server for q through conn, bypassing the
+// cache. Closing conn stores the answer and finishes the conn's flight.
+func refresh(ctx context.Context, conn *cacheConn, q dnsmessage.Question) (mErr error) {
+	defer capture(&mErr, conn.Close, "close refresh conn")
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	conn.qtype = q.Type
+	if err := conn.dialRealConn(); err != nil {
+		return fmt.Errorf("dial conn to refresh: %w", err)
+	}
+
+	query, err := newQuery(q)
+	if err != nil {
+		return fmt.Errorf("build query to refresh: %w", err)
+	}
+	conn.query = &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(query[2:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	if conn.stream {
+		query = frameMsg(query)
+	} else {
+		query = query[2:]
+	}
+	if conn.randomizeCase {
+		if query, err = conn.randomizeQueryCase(query); err != nil {
+			return fmt.Errorf("randomize case of query to refresh: %w", err)
+		}
+	}
+	conn.upstreamStart = time.Now()
+	if _, err := conn.realConn.Write(query); err != nil {
+		return fmt.Errorf("write query to refresh: %w", err)
+	}
+
+	b := make([]byte, maxUDPSize)
+	if conn.stream {
+		_, err = io.ReadAll(conn)
+	} else {
+		_, err = conn.Read(b)
+	}
+	if err != nil {
+		return fmt.Errorf("read response to refresh: %w", err)
+	}
+	return nil
+}
+
+// maxUDPSize is the EDNS0 UDP payload size advertised in queries, matching
+// the Go resolver.
+const maxUDPSize = 1232
+
+// newQuery returns a packed DNS query for q with a random ID and an EDNS0 OPT
+// record. The first 2 bytes are reserved for the stream length prefix.
+func newQuery(q dnsmessage.Question) ([]byte, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("generate query id: %w", err)
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{
+		ID:               binary.BigEndian.Uint16(id[:]),
+		RecursionDesired: true,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var rh dnsmessage.ResourceHeader
+	if err := rh.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(rh, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	_ Observer     = (*PrometheusObserver)(nil)
+	_ http.Handler = (*PrometheusObserver)(nil)
+)
+
+// latencyBuckets returns the upper bounds in seconds of the upstream latency
+// histogram buckets.
+func latencyBuckets() []float64 {
+	return []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+}
+
+// PrometheusObserver is an Observer that serves metrics in the Prometheus text
+// exposition format, without depending on the Prometheus client library. To
+// serve the metrics:
+//
+//	metrics := dns.NewPrometheusObserver()
+//	cache := &dns.Cache{Observer: metrics}
+//	http.Handle("/metrics", metrics)
+//
+// All metrics have a type label with the question type, like "A" or "HTTPS".
+type PrometheusObserver struct {
+	mu sync.Mutex
+	// counters maps a counter metric index to the count by question type.
+	counters [counterCount]map[dnsmessage.Type]int64
+	latency  map[dnsmessage.Type]*latencyHistogram
+	// buckets are the upper bounds of the latency histogram buckets.
+	buckets []float64
+}
+
+// Counter metric indexes into PrometheusObserver.counters.
+const (
+	counterHits = iota
+	counterMisses
+	counterFills
+	counterEvictions
+	counterUpstreamErrors
+	counterCount
+)
+
+// counterMetric returns the name and help text of a counter metric index.
+func counterMetric(counter int) (name, help string) {
+	switch counter {
+	case counterHits:
+		return "dns_cache_hits_total", "Queries answered from the cache."
+	case counterMisses:
+		return "dns_cache_misses_total", "Queries sent to the upstream DNS server."
+	case counterFills:
+		return "dns_cache_fills_total", "Upstream answers stored in the cache."
+	case counterEvictions:
+		return "dns_cache_evictions_total", "Answers evicted from the cache."
+	case counterUpstreamErrors:
+		return "dns_cache_upstream_errors_total", "Failed queries to the upstream DNS server."
+	default:
+		panic(fmt.Sprintf("dns: unknown counter metric %d", counter))
+	}
+}
+
+// latencyHistogram is a Prometheus histogram of upstream latency.
+type latencyHistogram struct {
+	// counts are the non-cumulative counts for each latency bucket.
+	// Latencies above the last bucket are only included in count.
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// NewPrometheusObserver returns a new PrometheusObserver with no events.
+func NewPrometheusObserver() *PrometheusObserver {
+	o := &PrometheusObserver{
+		latency: make(map[dnsmessage.Type]*latencyHistogram),
+		buckets: latencyBuckets(),
+	}
+	for i := range o.counters {
+		o.counters[i] = make(map[dnsmessage.Type]int64)
+	}
+	return o
+}
+
+func (o *PrometheusObserver) Hit(typ dnsmessage.Type)   { o.inc(counterHits, typ) }
+func (o *PrometheusObserver) Miss(typ dnsmessage.Type)  { o.inc(counterMisses, typ) }
+func (o *PrometheusObserver) Fill(typ dnsmessage.Type)  { o.inc(counterFills, typ) }
+func (o *PrometheusObserver) Evict(typ dnsmessage.Type) { o.inc(counterEvictions, typ) }
+
+func (o *PrometheusObserver) UpstreamError(typ dnsmessage.Type) {
+	o.inc(counterUpstreamErrors, typ)
+}
+
+func (o *PrometheusObserver) UpstreamLatency(typ dnsmessage.Type, d time.Duration) {
+	secs := d.Seconds()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h, ok := o.latency[typ]
+	if !ok {
+		h = &latencyHistogram{counts: make([]int64, len(o.buckets))}
+		o.latency[typ] = h
+	}
+	if i, _ := slices.BinarySearch(o.buckets, secs); i < len(o.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += secs
+}
+
+func (o *PrometheusObserver) inc(counter int, typ dnsmessage.Type) {
+	o.mu.Lock()
+	o.counters[counter][typ]++
+	o.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format,
+// version 0.0.4.
+func (o *PrometheusObserver) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	o.writeMetrics(bw)
+	_ = bw.Flush()
+}
+
+func (o *PrometheusObserver) writeMetrics(w io.Writer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i := range counterCount {
+		name, help := counterMetric(i)
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, typ := range slices.Sorted(maps.Keys(o.counters[i])) {
+			_, _ = fmt.Fprintf(w, "%s{type=%q} %d\n", name, TypeLabel(typ), o.counters[i][typ])
+		}
+	}
+
+	const name = "dns_cache_upstream_latency_seconds"
+	_, _ = fmt.Fprintf(w, "# HELP %s Latency of queries to the upstream DNS server.\n# TYPE %s histogram\n", name, name)
+	for _, typ := range slices.Sorted(maps.Keys(o.latency)) {
+		h, label := o.latency[typ], TypeLabel(typ)
+		var cumulative int64
+		for i, le := range o.buckets {
+			cumulative += h.counts[i]
+			le := strconv.FormatFloat(le, 'g', -1, 64)
+			_, _ = fmt.Fprintf(w, "%s_bucket{type=%q,le=%q} %d\n", name, label, le, cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket{type=%q,le=\"+Inf\"} %d\n", name, label, h.count)
+		_, _ = fmt.Fprintf(w, "%s_sum{type=%q} %s\n", name, label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		_, _ = fmt.Fprintf(w, "%s_count{type=%q} %d\n", name, label, h.count)
+	}
+}
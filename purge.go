@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"errors"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrPurgeUnsupported is returned when removing answers from a QuestionCache
+// that doesn't implement PurgeableQuestionCache.
+var ErrPurgeUnsupported = errors.New("dns: question cache doesn't support purging")
+
+// Delete removes the cached answer for q, forcing the next lookup of q to
+// query the upstream DNS server. The FQDN may omit the trailing dot and is
+// case-insensitive. A zero Class means dnsmessage.ClassINET. Returns true if
+// there was an answer.
+//
+// Returns ErrPurgeUnsupported if the QuestionCache doesn't implement
+// PurgeableQuestionCache.
+func (c *Cache) Delete(q Question) (bool, error) {
+	pc, err := c.purgeableCache()
+	if err != nil {
+		return false, err
+	}
+	q.FQDN = canonicalFQDN(q.FQDN)
+	if q.Class == 0 {
+		q.Class = dnsmessage.ClassINET
+	}
+	return pc.Delete(q), nil
+}
+
+// PurgeSuffix removes the cached answers for suffix and its subdomains of all
+// types, like "example.com" and "www.example.com" for the suffix
+// "example.com". The suffix may omit the trailing dot and is
+// case-insensitive. Returns the number of answers removed.
+//
+// Returns ErrPurgeUnsupported if the QuestionCache doesn't implement
+// PurgeableQuestionCache.
+func (c *Cache) PurgeSuffix(suffix string) (int, error) {
+	pc, err := c.purgeableCache()
+	if err != nil {
+		return 0, err
+	}
+	return pc.PurgeSuffix(canonicalFQDN(suffix)), nil
+}
+
+// Purge removes all cached answers. Returns the number of answers removed.
+//
+// Returns ErrPurgeUnsupported if the QuestionCache doesn't implement
+// PurgeableQuestionCache.
+func (c *Cache) Purge() (int, error) {
+	pc, err := c.purgeableCache()
+	if err != nil {
+		return 0, err
+	}
+	return pc.Purge(), nil
+}
+
+// deleteFunc removes the cached answers for questions where match returns
+// true. Returns the number of answers removed.
+func (c *Cache) deleteFunc(match func(Question) bool) (int, error) {
+	pc, err := c.purgeableCache()
+	if err != nil {
+		return 0, err
+	}
+	return pc.DeleteFunc(match), nil
+}
+
+func (c *Cache) purgeableCache() (PurgeableQuestionCache, error) {
+	c.init()
+	pc, ok := c.QuestionCache.(PurgeableQuestionCache)
+	if !ok {
+		return nil, ErrPurgeUnsupported
+	}
+	return pc, nil
+}
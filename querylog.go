@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// QueryEvent describes a query answered by a Cache.
+type QueryEvent struct {
+	// Time is when the resolver sent the query.
+	Time time.Time
+	// Question is the question name, like "example.com.". Empty if the query
+	// has multiple questions.
+	Question string
+	// Type is the question type, like "A". See TypeLabel.
+	Type string
+	// Server is the address of the upstream DNS server.
+	Server string
+	// Source is how the query was answered. See AttrCacheResult.
+	Source string
+	// RCode is the response code, like "RCodeSuccess". Empty if there was no
+	// response.
+	RCode string
+	// IPs are the IP addresses in the answer.
+	IPs []netip.Addr
+	// TTL is the TTL of the answer. Zero if the answer wasn't cached.
+	TTL time.Duration
+	// Latency is the time from sending the query until closing the conn.
+	Latency time.Duration
+	// Err is the error from the upstream DNS server, if any.
+	Err error
+}
+
+// QuerySink receives query events from a Cache.
+//
+// LogQuery is called synchronously when the resolver closes the conn for a
+// query, so it must be safe for concurrent use and return quickly.
+type QuerySink interface {
+	LogQuery(e QueryEvent)
+}
+
+// nopQuerySink is a QuerySink that ignores all events.
+type nopQuerySink struct{}
+
+func (nopQuerySink) LogQuery(QueryEvent) {}
+
+var _ QuerySink = (*JSONLinesSink)(nil)
+
+// JSONLinesSink is a QuerySink that writes each event as a line of JSON, like:
+//
+//	{"time":"2025-01-02T15:04:05Z","question":"example.com.","type":"A","server":"10.0.0.53:53","source":"hit","rcode":"RCodeSuccess","ips":["93.184.215.14"],"ttl_seconds":42,"latency_seconds":0.000012}
+type JSONLinesSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewJSONLinesSink returns a JSONLinesSink that writes to w.
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{enc: json.NewEncoder(w)}
+}
+
+// jsonQueryEvent is the JSON representation of a QueryEvent.
+type jsonQueryEvent struct {
+	Time           time.Time    `json:"time"`
+	Question       string       `json:"question"`
+	Type           string       `json:"type"`
+	Server         string       `json:"server"`
+	Source         string       `json:"source"`
+	RCode          string       `json:"rcode,omitempty"`
+	IPs            []netip.Addr `json:"ips,omitempty"`
+	TTLSeconds     float64      `json:"ttl_seconds"`
+	LatencySeconds float64      `json:"latency_seconds"`
+	Error          string       `json:"error,omitempty"`
+}
+
+// LogQuery writes e as a line of JSON. After the first write error, LogQuery
+// does nothing. See Err.
+func (s *JSONLinesSink) LogQuery(e QueryEvent) {
+	je := jsonQueryEvent{
+		Time:           e.Time,
+		Question:       e.Question,
+		Type:           e.Type,
+		Server:         e.Server,
+		Source:         e.Source,
+		RCode:          e.RCode,
+		IPs:            e.IPs,
+		TTLSeconds:     e.TTL.Seconds(),
+		LatencySeconds: e.Latency.Seconds(),
+	}
+	if e.Err != nil {
+		je.Error = e.Err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	if err := s.enc.Encode(je); err != nil {
+		s.err = fmt.Errorf("write query event: %w", err)
+	}
+}
+
+// Err returns the first error writing an event, if any.
+func (s *JSONLinesSink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+var _ QuerySink = (*RingBufferSink)(nil)
+
+// RingBufferSink is a QuerySink that keeps the most recent events in memory.
+type RingBufferSink struct {
+	mu     sync.Mutex
+	events []QueryEvent
+	// next is the index in events for the next event.
+	next int
+	// full is true once events has wrapped around.
+	full bool
+}
+
+// NewRingBufferSink returns a RingBufferSink that keeps the most recent size
+// events. Panics if size is not positive.
+func NewRingBufferSink(size int) *RingBufferSink {
+	if size <= 0 {
+		panic(fmt.Sprintf("dns: non-positive ring buffer size %d", size))
+	}
+	return &RingBufferSink{events: make([]QueryEvent, size)}
+}
+
+// LogQuery stores e, replacing the oldest event if the buffer is full.
+func (s *RingBufferSink) LogQuery(e QueryEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[s.next] = e
+	s.next = (s.next + 1) % len(s.events)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// Events returns a copy of the stored events from oldest to newest.
+func (s *RingBufferSink) Events() []QueryEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.full {
+		return append([]QueryEvent(nil), s.events[:s.next]...)
+	}
+	events := make([]QueryEvent, 0, len(s.events))
+	events = append(events, s.events[s.next:]...)
+	return append(events, s.events[:s.next]...)
+}
@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCache_QueryLog(t *testing.T) {
+	host := "test-cache-query-log.example.com."
+	ip := netip.MustParseAddr("10.0.0.1")
+	fakeDNS := startDNSServer(t, host, ip)
+	sink := NewRingBufferSink(2)
+	cache := &Cache{
+		Dial:     fakeDNS.DialContext,
+		QueryLog: sink,
+	}
+	cache.init()
+	for _, name := range []string{host, host, host, "missing." + host} {
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+		_, _ = cache.exchange(t.Context(), "udp", "127.0.0.1:53", q)
+	}
+
+	// The ring buffer keeps the last 2 events.
+	want := []QueryEvent{
+		{Question: host, Type: "A", Server: "127.0.0.1:53", Source: "hit", RCode: "RCodeSuccess", IPs: []netip.Addr{ip}},
+		{Question: "missing." + host, Type: "A", Server: "127.0.0.1:53", Source: "miss", RCode: "RCodeNameError", TTL: 30 * time.Second},
+	}
+	got := sink.Events()
+	if len(got) != len(want) {
+		t.Fatalf("want %d events; got %d: %+v", len(want), len(got), got)
+	}
+	for i := range got {
+		if got[i].Time.IsZero() || got[i].Latency <= 0 {
+			t.Errorf("event %d: want time and latency; got %+v", i, got[i])
+		}
+		if got[i].Source == "hit" && (got[i].TTL <= 0 || got[i].TTL > time.Minute) {
+			t.Errorf("event %d: want remaining TTL of at most 1m; got %s", i, got[i].TTL)
+		}
+		got[i].Time, got[i].Latency = time.Time{}, 0
+		if len(got[i].IPs) == 0 {
+			got[i].IPs = nil
+		}
+		if got[i].Source == "hit" {
+			got[i].TTL = 0
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events mismatch\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLinesSink(&buf)
+	sink.LogQuery(QueryEvent{
+		Time:     time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC),
+		Question: "example.com.",
+		Type:     "A",
+		Server:   "10.0.0.53:53",
+		Source:   "miss",
+		RCode:    "RCodeSuccess",
+		IPs:      []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		TTL:      time.Minute,
+		Latency:  1500 * time.Microsecond,
+	})
+	sink.LogQuery(QueryEvent{Question: "example.org.", Type: "AAAA", Source: "miss", Err: errors.New("timeout")})
+
+	want := `{"time":"2025-01-02T15:04:05Z","question":"example.com.","type":"A","server":"10.0.0.53:53",` +
+		`"source":"miss","rcode":"RCodeSuccess","ips":["192.0.2.1"],"ttl_seconds":60,"latency_seconds":0.0015}` + "\n" +
+		`{"time":"0001-01-01T00:00:00Z","question":"example.org.","type":"AAAA","server":"","source":"miss",` +
+		`"ttl_seconds":0,"latency_seconds":0,"error":"timeout"}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("JSON lines mismatch\nwant: %s\ngot:  %s", want, got)
+	}
+	if err := sink.Err(); err != nil {
+		t.Errorf("Err: %v", err)
+	}
+}
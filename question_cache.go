@@ -1,8 +1,14 @@
 package dns
 
 import (
+	"container/list"
+	"errors"
 	"fmt"
+	"iter"
+	"math"
 	"net/netip"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,43 +22,167 @@ type QuestionCache interface {
 	Set(q Question, a Answer)
 }
 
+// StaleQuestionCache is an optional interface for a QuestionCache that retains
+// expired answers. Cache uses GetStale to serve stale answers when the
+// upstream DNS server fails, per RFC 8767.
+type StaleQuestionCache interface {
+	QuestionCache
+	// GetStale returns the answer for q, even if the answer is expired.
+	GetStale(q Question) (Answer, bool)
+}
+
+// PurgeableQuestionCache is an optional interface for a QuestionCache that
+// supports removing answers before they expire. Cache uses it to force the
+// next lookup to query the upstream DNS server, like after a DNS change.
+type PurgeableQuestionCache interface {
+	QuestionCache
+	// Delete removes the answer for q. Returns true if there was an answer.
+	Delete(q Question) bool
+	// PurgeSuffix removes the answers for questions about suffix and its
+	// subdomains. The suffix is a lowercase FQDN with a trailing dot, like
+	// "example.com.". The suffix "." removes all answers. Returns the number
+	// of answers removed.
+	PurgeSuffix(suffix string) int
+	// Purge removes all answers. Returns the number of answers removed.
+	Purge() int
+	// DeleteFunc removes the answers for questions where match returns true.
+	// Returns the number of answers removed. match must not call methods of
+	// the cache.
+	DeleteFunc(match func(Question) bool) int
+}
+
+// IterableQuestionCache is an optional interface for a QuestionCache that
+// enumerates its answers, like for admin views, persistence, or warming
+// another cache.
+type IterableQuestionCache interface {
+	QuestionCache
+	// All returns an iterator over the questions and answers, including
+	// expired answers. Iterating must not block other methods, so yield may
+	// call other methods of the cache. Changes during iteration may not be
+	// reflected.
+	All() iter.Seq2[Question, Answer]
+}
+
 // Question is a DNS question. This is a simplified representation of
 // dnsmessage.Question.
 type Question struct {
 	// FQDN is the fully qualified domain name with a trailing dot,
-	// e.g. "example.com.".
+	// e.g. "example.com.". Cache uses lowercase names since DNS names are
+	// case-insensitive.
 	FQDN string
-	// Type is the type of question. Must be either dnsmessage.TypeA or
-	// dnsmessage.TypeAAAA.
+	// Type is the type of question, e.g. dnsmessage.TypeA or
+	// dnsmessage.TypeSRV.
 	Type dnsmessage.Type
+	// Class is the class of the question, usually dnsmessage.ClassINET.
+	Class dnsmessage.Class
+	// Namespace partitions the cache so the same question has separate
+	// answers, e.g. per upstream DNS server. Empty if the cache is not
+	// partitioned.
+	Namespace string
 }
 
-// newQuestion creates a new Question from a dnsmessage.Question.
-func newQuestion(q dnsmessage.Question) Question {
-	return Question{FQDN: q.Name.String(), Type: q.Type}
+// newQuestion creates a new Question in namespace from a dnsmessage.Question.
+// The FQDN is lowercase so questions differing only in case share an answer.
+func newQuestion(q dnsmessage.Question, namespace string) Question {
+	return Question{FQDN: canonicalName(q.Name.String()), Type: q.Type, Class: q.Class, Namespace: namespace}
 }
 
 // Answer is the DNS answer for a Question. This is a simplified representation
 // of dnsmessage.Message answers.
+//
+// A/AAAA records are stored as IPs and CNAME records as CNAMEs. Records of
+// any other type, like SRV or TXT, are stored as Records.
+//
+// A negative answer, per RFC 2308, has no IPs or Records. The RCode is
+// dnsmessage.RCodeNameError for NXDOMAIN or dnsmessage.RCodeSuccess for NODATA.
 type Answer struct {
 	// FetchTime is when the DNS record was requested.
 	FetchTime time.Time
-	// TTL is how long the answer is valid for.
+	// TTL is how long the answer is valid for. The TTL is the minimum TTL of
+	// all records, including CNAMEs. For negative answers, the TTL is derived
+	// from the SOA record in the authority section.
 	TTL time.Duration
+	// RCode is the response code of the DNS response.
+	RCode dnsmessage.RCode
+	// Flags are the header flags and EDNS0 parameters of the DNS response.
+	Flags ResponseFlags
+	// CNAMEs is the CNAME chain from the question name to the canonical name,
+	// in order. Empty if the question name is the canonical name.
+	CNAMEs []CNAME
 	// IPs are the IP addresses for the DNS record.
 	IPs []netip.Addr
+	// Records are the answer records of types other than A, AAAA, and CNAME.
+	Records []dnsmessage.Resource
+	// SOA is the SOA record from the authority section of a negative answer.
+	// Responses built from the cache include it so downstream caches can
+	// cache the negative answer, per RFC 2308. Nil for positive answers.
+	SOA *dnsmessage.Resource
+	// Raw is the packed upstream DNS response, without a length prefix. If
+	// set, cache hits replay Raw instead of building a response from the other
+	// fields. Only set if Cache.RawResponses is true.
+	Raw []byte
+}
+
+// ResponseFlags are the header flags and EDNS0 parameters of an upstream DNS
+// response. Responses built from the cache use the same flags.
+type ResponseFlags struct {
+	// Authoritative is the AA bit.
+	Authoritative bool
+	// RecursionAvailable is the RA bit.
+	RecursionAvailable bool
+	// AuthenticData is the AD bit, per RFC 4035.
+	AuthenticData bool
+	// EDNS0 is true if the response has an OPT record, per RFC 6891.
+	EDNS0 bool
+	// UDPSize is the UDP payload size of the OPT record.
+	UDPSize uint16
+	// DNSSECOK is the DO bit of the OPT record, per RFC 3225.
+	DNSSECOK bool
+}
+
+func newResponseFlags(m *dnsmessage.Message) ResponseFlags {
+	f := ResponseFlags{
+		Authoritative:      m.Authoritative,
+		RecursionAvailable: m.RecursionAvailable,
+		AuthenticData:      m.AuthenticData,
+	}
+	for _, r := range m.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			f.EDNS0 = true
+			f.UDPSize = uint16(r.Header.Class)
+			f.DNSSECOK = r.Header.DNSSECAllowed()
+		}
+	}
+	return f
 }
 
+// CNAME is a link in a CNAME chain.
+type CNAME struct {
+	// Name is the alias, e.g. "api.example.com.".
+	Name string
+	// Target is the name the alias points to, e.g. "lb.example.net.".
+	Target string
+	// TTL is how long the CNAME record is valid for.
+	TTL time.Duration
+}
+
+// errUncacheable indicates a valid DNS response that must not be cached.
+var errUncacheable = errors.New("uncacheable dns response")
+
 func newAnswer(m *dnsmessage.Message) (Answer, error) {
-	if len(m.Answers) == 0 {
-		return Answer{}, fmt.Errorf("no answers in DNS message")
+	if m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError {
+		return Answer{}, fmt.Errorf("%w: rcode %s", errUncacheable, m.RCode)
 	}
 	a := Answer{
 		FetchTime: time.Now(),
-		TTL:       time.Duration(m.Answers[0].Header.TTL) * time.Second,
+		RCode:     m.RCode,
+		Flags:     newResponseFlags(m),
 		IPs:       make([]netip.Addr, 0, len(m.Answers)),
 	}
+	// The TTL of an RRset is the minimum TTL of its records.
+	ttl := uint32(math.MaxUint32)
 	for _, r := range m.Answers {
+		ttl = min(ttl, r.Header.TTL)
 		//nolint:exhaustive
 		switch r.Header.Type {
 		case dnsmessage.TypeA:
@@ -67,62 +197,311 @@ func newAnswer(m *dnsmessage.Message) (Answer, error) {
 				return Answer{}, fmt.Errorf("invalid AAAA record body: %v", r.Body)
 			}
 			a.IPs = append(a.IPs, netip.AddrFrom16(res.AAAA))
+		case dnsmessage.TypeCNAME:
+			res, ok := r.Body.(*dnsmessage.CNAMEResource)
+			if !ok {
+				return Answer{}, fmt.Errorf("invalid CNAME record body: %v", r.Body)
+			}
+			a.CNAMEs = append(a.CNAMEs, CNAME{
+				Name:   r.Header.Name.String(),
+				Target: res.CNAME.String(),
+				TTL:    time.Duration(r.Header.TTL) * time.Second,
+			})
 		default:
-			return Answer{}, fmt.Errorf("unsupported record type: %v", r.Header.Type)
+			a.Records = append(a.Records, r)
 		}
 	}
+	if len(m.Questions) == 1 {
+		a.CNAMEs = chainCNAMEs(m.Questions[0].Name.String(), a.CNAMEs)
+	}
+	if m.RCode == dnsmessage.RCodeNameError || (len(a.IPs) == 0 && len(a.Records) == 0) {
+		soa, negTTL, err := negativeTTL(m)
+		if err != nil {
+			return Answer{}, err
+		}
+		a.SOA = &soa
+		ttl = min(ttl, negTTL)
+	}
+	a.TTL = time.Duration(ttl) * time.Second
 	return a, nil
 }
 
+// chainCNAMEs returns the CNAME links in chain order, starting from the
+// question name qname. Responses may list CNAME records in any order. Links
+// not part of the chain are dropped. Names are compared case-insensitively.
+func chainCNAMEs(qname string, links []CNAME) []CNAME {
+	var chain []CNAME
+	used := make([]bool, len(links))
+	name := canonicalName(qname)
+	for {
+		i := slices.IndexFunc(links, func(l CNAME) bool { return canonicalName(l.Name) == name })
+		// A link already in the chain means the chain loops.
+		if i < 0 || used[i] {
+			return chain
+		}
+		used[i] = true
+		chain = append(chain, links[i])
+		name = canonicalName(links[i].Target)
+	}
+}
+
+// negativeTTL returns the SOA record and the TTL for an NXDOMAIN or NODATA
+// response. The TTL is the minimum of the SOA record TTL and the SOA MINIMUM
+// field, per RFC 2308 section 5. Negative responses without an SOA record are
+// not cached.
+func negativeTTL(m *dnsmessage.Message) (dnsmessage.Resource, uint32, error) {
+	for _, r := range m.Authorities {
+		if r.Header.Type != dnsmessage.TypeSOA {
+			continue
+		}
+		soa, ok := r.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			return dnsmessage.Resource{}, 0, fmt.Errorf("invalid SOA record body: %v", r.Body)
+		}
+		return r, min(r.Header.TTL, soa.MinTTL), nil
+	}
+	return dnsmessage.Resource{}, 0, fmt.Errorf("%w: negative response without SOA record", errUncacheable)
+}
+
 func (a Answer) IsExpired() bool {
 	return a.FetchTime.Add(a.TTL).Before(time.Now())
 }
 
+// RemainingTTL returns how long until the answer expires. Returns a negative
+// duration if the answer is expired.
+func (a Answer) RemainingTTL() time.Duration {
+	return time.Until(a.FetchTime.Add(a.TTL))
+}
+
 func (a Answer) GoString() string {
-	return fmt.Sprintf("Answer{FetchTime: %s, TTL: %ds, IPs: %v}", a.FetchTime.Format(time.DateTime), int(a.TTL.Seconds()), a.IPs)
+	records := make([]string, 0, len(a.Records))
+	for _, r := range a.Records {
+		records = append(records, r.GoString())
+	}
+	soa := "nil"
+	if a.SOA != nil {
+		soa = a.SOA.GoString()
+	}
+	return fmt.Sprintf("Answer{FetchTime: %s, TTL: %ds, RCode: %s, Flags: %+v, CNAMEs: %v, IPs: %v, Records: [%s], SOA: %s}", a.FetchTime.Format(time.DateTime), int(a.TTL.Seconds()), a.RCode, a.Flags, a.CNAMEs, a.IPs, strings.Join(records, ", "), soa)
 }
 
-var _ QuestionCache = &questionCache{}
+var (
+	_ StaleQuestionCache     = &questionCache{}
+	_ PurgeableQuestionCache = &questionCache{}
+	_ IterableQuestionCache  = &questionCache{}
+)
 
+// questionCache is the default, in-memory QuestionCache. If maxEntries is
+// positive, questionCache evicts the least recently used answer when full.
 type questionCache struct {
-	m      map[Question]Answer
-	mu     sync.RWMutex
-	hits   *atomic.Int64
-	misses *atomic.Int64
+	// maxEntries is the maximum number of answers. Zero means unbounded.
+	maxEntries int
+	// maxStale is how long to retain expired answers for GetStale.
+	maxStale time.Duration
+	// m maps a question to its element in lru.
+	m map[Question]*list.Element
+	// lru orders entries from most to least recently used. Each element value
+	// is a *questionEntry.
+	lru       *list.List
+	mu        sync.Mutex
+	hits      *atomic.Int64
+	misses    *atomic.Int64
+	evictions *atomic.Int64
+	// onEvict is called without holding mu for each question evicted to stay
+	// within maxEntries. Nil if unused.
+	onEvict func(Question)
+}
+
+type questionEntry struct {
+	q Question
+	a Answer
+	// hits is the number of Get calls that returned a.
+	hits int64
 }
 
 func newQuestionCache() *questionCache {
 	return &questionCache{
-		m:      make(map[Question]Answer),
-		hits:   new(atomic.Int64),
-		misses: new(atomic.Int64),
+		m:         make(map[Question]*list.Element),
+		lru:       list.New(),
+		hits:      new(atomic.Int64),
+		misses:    new(atomic.Int64),
+		evictions: new(atomic.Int64),
 	}
 }
 
 func (c *questionCache) Get(q Question) (Answer, bool) {
-	c.mu.RLock()
-	a, ok := c.m[q]
-	c.mu.RUnlock()
-
+	c.mu.Lock()
+	elem, ok := c.m[q]
 	if !ok {
+		c.mu.Unlock()
 		c.misses.Add(1)
 		return Answer{}, false
 	}
 
+	a := elem.Value.(*questionEntry).a
 	if a.IsExpired() {
-		c.mu.Lock()
-		delete(c.m, q)
+		if c.isRemovable(a) {
+			c.removeElement(elem)
+		}
 		c.mu.Unlock()
 		c.misses.Add(1)
 		return Answer{}, false
 	}
 
+	c.lru.MoveToFront(elem)
+	elem.Value.(*questionEntry).hits++
+	c.mu.Unlock()
 	c.hits.Add(1)
 	return a, true
 }
 
+// GetStale returns the answer for q, even if expired. Only answers expired for
+// less than maxStale are retained.
+func (c *questionCache) GetStale(q Question) (Answer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.m[q]
+	if !ok {
+		return Answer{}, false
+	}
+	return elem.Value.(*questionEntry).a, true
+}
+
 func (c *questionCache) Set(q Question, a Answer) {
 	c.mu.Lock()
-	c.m[q] = a
+	if elem, ok := c.m[q]; ok {
+		elem.Value.(*questionEntry).a = a
+		c.lru.MoveToFront(elem)
+		c.mu.Unlock()
+		return
+	}
+
+	c.m[q] = c.lru.PushFront(&questionEntry{q: q, a: a})
+	var evicted []Question
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		back := c.lru.Back()
+		evicted = append(evicted, back.Value.(*questionEntry).q)
+		c.removeElement(back)
+		c.evictions.Add(1)
+	}
 	c.mu.Unlock()
+
+	if c.onEvict != nil {
+		for _, eq := range evicted {
+			c.onEvict(eq)
+		}
+	}
+}
+
+// len returns the number of answers, including expired answers.
+func (c *questionCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
+
+func (c *questionCache) Delete(q Question) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.m[q]
+	if ok {
+		c.removeElement(elem)
+	}
+	return ok
+}
+
+func (c *questionCache) PurgeSuffix(suffix string) int {
+	return c.removeIf(func(q Question) bool { return hasNameSuffix(q.FQDN, suffix) })
+}
+
+func (c *questionCache) DeleteFunc(match func(Question) bool) int {
+	return c.removeIf(match)
+}
+
+func (c *questionCache) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.m)
+	clear(c.m)
+	c.lru.Init()
+	return n
+}
+
+// All returns an iterator over a snapshot of the answers from most to least
+// recently used. The lock is only held to copy the answers, not while calling
+// yield.
+func (c *questionCache) All() iter.Seq2[Question, Answer] {
+	return func(yield func(Question, Answer) bool) {
+		for _, e := range c.entries() {
+			if !yield(e.q, e.a) {
+				return
+			}
+		}
+	}
+}
+
+// Snapshot returns a copy of all answers, including expired answers, at a
+// single point in time.
+func (c *questionCache) Snapshot() map[Question]Answer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[Question]Answer, len(c.m))
+	for q, elem := range c.m {
+		m[q] = elem.Value.(*questionEntry).a
+	}
+	return m
+}
+
+// entries returns a copy of all entries, including expired entries, from most
+// to least recently used.
+func (c *questionCache) entries() []questionEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]questionEntry, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, *elem.Value.(*questionEntry))
+	}
+	return entries
+}
+
+// removeIf removes all entries where the question matches and returns the
+// number removed.
+func (c *questionCache) removeIf(match func(Question) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for q, elem := range c.m {
+		if match(q) {
+			c.removeElement(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// removeExpired removes all answers expired for longer than maxStale and
+// returns the number removed.
+func (c *questionCache) removeExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, elem := range c.m {
+		if c.isRemovable(elem.Value.(*questionEntry).a) {
+			c.removeElement(elem)
+			n++
+		}
+	}
+	return n
+}
+
+// isRemovable returns true if the answer is expired and not retained to serve
+// stale.
+func (c *questionCache) isRemovable(a Answer) bool {
+	return a.FetchTime.Add(a.TTL + c.maxStale).Before(time.Now())
+}
+
+// removeElement removes an entry from the cache. Requires c.mu.
+func (c *questionCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.m, elem.Value.(*questionEntry).q)
 }
@@ -1,7 +1,9 @@
 package dns
 
 import (
+	"errors"
 	"net/netip"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -42,6 +44,270 @@ func TestQuestionCache_Get(t *testing.T) {
 	assertHitsMisses(t, qc, 1, 2)
 }
 
+func TestQuestionCache_Evict(t *testing.T) {
+	qc := newQuestionCache()
+	qc.maxEntries = 2
+
+	q1 := Question{FQDN: "one.example.com.", Type: dnsmessage.TypeA}
+	q2 := Question{FQDN: "two.example.com.", Type: dnsmessage.TypeA}
+	q3 := Question{FQDN: "three.example.com.", Type: dnsmessage.TypeA}
+	a1 := Answer{
+		FetchTime: time.Now(),
+		TTL:       time.Minute,
+		IPs:       []netip.Addr{netip.MustParseAddr("1.2.3.4")},
+	}
+
+	qc.Set(q1, a1)
+	qc.Set(q2, a1)
+	// Replacing an existing entry doesn't evict.
+	qc.Set(q2, a1)
+	assertEvictions(t, qc, 0)
+
+	// Use q1 so q2 is the least recently used.
+	if _, ok := qc.Get(q1); !ok {
+		t.Fatalf("want q1 present; got missing")
+	}
+	qc.Set(q3, a1)
+	assertEvictions(t, qc, 1)
+
+	if _, ok := qc.Get(q2); ok {
+		t.Errorf("want q2 evicted; got present")
+	}
+	for _, q := range []Question{q1, q3} {
+		if _, ok := qc.Get(q); !ok {
+			t.Errorf("want %s present; got missing", q.FQDN)
+		}
+	}
+}
+
+func TestQuestionCache_Purge(t *testing.T) {
+	qc := newQuestionCache()
+	a := Answer{FetchTime: time.Now(), TTL: time.Minute, IPs: []netip.Addr{netip.MustParseAddr("1.2.3.4")}}
+	apex := Question{FQDN: "example.com.", Type: dnsmessage.TypeA}
+	www := Question{FQDN: "www.example.com.", Type: dnsmessage.TypeA}
+	other := Question{FQDN: "notexample.com.", Type: dnsmessage.TypeA}
+	for _, q := range []Question{apex, www, other} {
+		qc.Set(q, a)
+	}
+
+	if !qc.Delete(www) {
+		t.Errorf("Delete www: want true; got false")
+	}
+	if qc.Delete(www) {
+		t.Errorf("Delete www again: want false; got true")
+	}
+	qc.Set(www, a)
+
+	if got := qc.DeleteFunc(func(q Question) bool { return q.FQDN == www.FQDN }); got != 1 {
+		t.Errorf("DeleteFunc www: got %d; want 1", got)
+	}
+	qc.Set(www, a)
+
+	// The suffix only matches whole labels.
+	if got := qc.PurgeSuffix("example.com."); got != 2 {
+		t.Errorf("PurgeSuffix: got %d; want 2", got)
+	}
+	if _, ok := qc.Get(other); !ok {
+		t.Errorf("want %s present; got missing", other.FQDN)
+	}
+	if got := qc.Purge(); got != 1 {
+		t.Errorf("Purge: got %d; want 1", got)
+	}
+	if got := qc.len(); got != 0 {
+		t.Errorf("want empty cache after Purge; got %d entries", got)
+	}
+}
+
+func TestQuestionCache_All(t *testing.T) {
+	qc := newQuestionCache()
+	a := Answer{FetchTime: time.Now(), TTL: time.Minute, IPs: []netip.Addr{netip.MustParseAddr("1.2.3.4")}}
+	q1 := Question{FQDN: "one.example.com.", Type: dnsmessage.TypeA}
+	q2 := Question{FQDN: "two.example.com.", Type: dnsmessage.TypeA}
+	q3 := Question{FQDN: "three.example.com.", Type: dnsmessage.TypeA}
+	qc.Set(q1, a)
+	qc.Set(q2, a)
+	snapshot := qc.Snapshot()
+
+	// Yield may modify the cache without deadlocking. The iteration uses the
+	// answers at the start.
+	var got []Question
+	for q := range qc.All() {
+		got = append(got, q)
+		qc.Set(q3, a)
+		qc.Delete(q1)
+	}
+	if want := []Question{q2, q1}; !slices.Equal(got, want) {
+		t.Errorf("All: got %v; want %v", got, want)
+	}
+
+	// The snapshot doesn't change with the cache.
+	if len(snapshot) != 2 {
+		t.Errorf("Snapshot: want 2 answers; got %v", snapshot)
+	}
+	for _, q := range []Question{q1, q2} {
+		if _, ok := snapshot[q]; !ok {
+			t.Errorf("Snapshot: want %s present; got missing", q.FQDN)
+		}
+	}
+}
+
+func TestQuestionCache_RemoveExpired(t *testing.T) {
+	qc := newQuestionCache()
+
+	q1 := Question{FQDN: "one.example.com.", Type: dnsmessage.TypeA}
+	q2 := Question{FQDN: "two.example.com.", Type: dnsmessage.TypeA}
+	ips := []netip.Addr{netip.MustParseAddr("1.2.3.4")}
+	qc.Set(q1, Answer{FetchTime: time.Now().Add(-time.Minute), TTL: time.Second, IPs: ips})
+	qc.Set(q2, Answer{FetchTime: time.Now(), TTL: time.Minute, IPs: ips})
+
+	if got := qc.removeExpired(); got != 1 {
+		t.Errorf("removeExpired: got %d; want 1", got)
+	}
+	if _, ok := qc.m[q1]; ok {
+		t.Errorf("want expired q1 removed; got present")
+	}
+	if _, ok := qc.m[q2]; !ok {
+		t.Errorf("want q2 present; got missing")
+	}
+}
+
+func TestNewAnswer_MinTTL(t *testing.T) {
+	newA := func(ttl uint32, ip string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			},
+			Body: &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()},
+		}
+	}
+	msg := &dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{newA(300, "1.2.3.4"), newA(20, "1.2.3.5"), newA(60, "1.2.3.6")},
+	}
+
+	got, err := newAnswer(msg)
+	if err != nil {
+		t.Fatalf("newAnswer: %v", err)
+	}
+	if got.TTL != 20*time.Second {
+		t.Errorf("TTL: got %s; want minimum TTL 20s", got.TTL)
+	}
+}
+
+func TestNewAnswer_CNAMEOrder(t *testing.T) {
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("api.example.com."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}
+	ip := netip.MustParseAddr("10.0.0.1")
+	// The CNAME records are out of order, and one is unrelated to the chain.
+	msg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{
+			newCNAMEResource("lb.example.net.", "lb2.example.net.", 60),
+			newCNAMEResource("other.example.org.", "lb.example.net.", 60),
+			newCNAMEResource("API.example.com.", "lb.example.net.", 60),
+			{
+				Header: dnsmessage.ResourceHeader{
+					Name:  dnsmessage.MustNewName("lb2.example.net."),
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.AResource{A: ip.As4()},
+			},
+		},
+	}
+
+	got, err := newAnswer(msg)
+	if err != nil {
+		t.Fatalf("newAnswer: %v", err)
+	}
+	want := Answer{
+		FetchTime: got.FetchTime,
+		TTL:       60 * time.Second,
+		CNAMEs: []CNAME{
+			{Name: "API.example.com.", Target: "lb.example.net.", TTL: 60 * time.Second},
+			{Name: "lb.example.net.", Target: "lb2.example.net.", TTL: 60 * time.Second},
+		},
+		IPs: []netip.Addr{ip},
+	}
+	assertSameAnswer(t, want, got)
+
+	answers, err := buildAnswers(q, got)
+	if err != nil {
+		t.Fatalf("buildAnswers: %v", err)
+	}
+	wantNames := []string{"API.example.com.", "lb.example.net.", "lb2.example.net."}
+	if len(answers) != len(wantNames) {
+		t.Fatalf("want %d answers; got %v", len(wantNames), answers)
+	}
+	for i, r := range answers {
+		if got := r.Header.Name.String(); got != wantNames[i] {
+			t.Errorf("answer %d name: got %s; want %s", i, got, wantNames[i])
+		}
+	}
+}
+
+func TestNewAnswer_Negative(t *testing.T) {
+	soa := newSOAResource("example.com.")
+	tests := []struct {
+		name    string
+		msg     *dnsmessage.Message
+		want    Answer
+		wantErr error
+	}{
+		{
+			name: "NXDOMAIN",
+			msg: &dnsmessage.Message{
+				Header:      dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+				Authorities: []dnsmessage.Resource{soa},
+			},
+			want: Answer{TTL: 30 * time.Second, RCode: dnsmessage.RCodeNameError, SOA: &soa},
+		},
+		{
+			name: "NODATA",
+			msg: &dnsmessage.Message{
+				Header:      dnsmessage.Header{Response: true},
+				Authorities: []dnsmessage.Resource{soa},
+			},
+			want: Answer{TTL: 30 * time.Second, SOA: &soa},
+		},
+		{
+			name: "NXDOMAIN without SOA",
+			msg: &dnsmessage.Message{
+				Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+			},
+			wantErr: errUncacheable,
+		},
+		{
+			name: "SERVFAIL",
+			msg: &dnsmessage.Message{
+				Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure},
+			},
+			wantErr: errUncacheable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newAnswer(tt.msg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newAnswer error: got %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			tt.want.FetchTime = got.FetchTime
+			assertSameAnswer(t, tt.want, got)
+		})
+	}
+}
+
 const (
 	goroutineCount = 8
 	runCount       = 256
@@ -138,3 +404,13 @@ func assertHitsMisses(t *testing.T, qc *questionCache, wantHits, wantMisses int6
 		t.Errorf("misses: got = %d; want %d", got, wantMisses)
 	}
 }
+
+func assertEvictions(t *testing.T, qc *questionCache, want int64) {
+	t.Helper()
+	if got := qc.evictions.Load(); got != want {
+		t.Errorf("evictions: got = %d; want %d", got, want)
+	}
+	if got := qc.lru.Len(); got != len(qc.m) {
+		t.Errorf("lru length %d does not match map length %d", got, len(qc.m))
+	}
+}
@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// headerLen is the length of the DNS message header, per RFC 1035 section
+// 4.1.1.
+const headerLen = 12
+
+// rewriteRawResp returns a copy of the packed DNS response raw with the ID set
+// to id and the TTL of each record set to remaining, the remaining TTL of the
+// answer, with a floor of minResponseTTL. OPT records are unchanged since the
+// TTL field holds EDNS0 flags.
+//
+// Everything else in the response is byte-for-byte identical to raw.
+func rewriteRawResp(raw []byte, id uint16, remaining time.Duration) ([]byte, error) {
+	if len(raw) < headerLen {
+		return nil, fmt.Errorf("dns message length %d shorter than header", len(raw))
+	}
+	b := slices.Clone(raw)
+	binary.BigEndian.PutUint16(b, id)
+
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	rrCount := int(binary.BigEndian.Uint16(b[6:])) + // answers
+		int(binary.BigEndian.Uint16(b[8:])) + // authorities
+		int(binary.BigEndian.Uint16(b[10:])) // additionals
+
+	off := headerLen
+	var err error
+	for range qdCount {
+		if off, err = skipName(b, off); err != nil {
+			return nil, fmt.Errorf("skip question name: %w", err)
+		}
+		off += 4 // type and class
+	}
+	for range rrCount {
+		if off, err = skipName(b, off); err != nil {
+			return nil, fmt.Errorf("skip record name: %w", err)
+		}
+		// Type (2), class (2), TTL (4), and RDLENGTH (2).
+		if off+10 > len(b) {
+			return nil, fmt.Errorf("record header at offset %d exceeds message", off)
+		}
+		typ := dnsmessage.Type(binary.BigEndian.Uint16(b[off:]))
+		if typ != dnsmessage.TypeOPT {
+			binary.BigEndian.PutUint32(b[off+4:], responseTTL(remaining))
+		}
+		off += 10 + int(binary.BigEndian.Uint16(b[off+8:]))
+	}
+	if off > len(b) {
+		return nil, fmt.Errorf("records end at offset %d beyond message length %d", off, len(b))
+	}
+	return b, nil
+}
+
+// skipName returns the offset after the domain name at off. Compressed names
+// end with a 2-byte pointer, per RFC 1035 section 4.1.4.
+func skipName(b []byte, off int) (int, error) {
+	for {
+		if off >= len(b) {
+			return 0, fmt.Errorf("name at offset %d exceeds message", off)
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xC0 == 0xC0:
+			return off + 2, nil
+		case l > 63:
+			return 0, fmt.Errorf("invalid label length %d at offset %d", l, off)
+		default:
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRewriteRawResp(t *testing.T) {
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, true); err != nil {
+		t.Fatalf("SetEDNS0: %v", err)
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, Response: true, AuthenticData: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+		Answers: []dnsmessage.Resource{
+			newCNAMEResource("www.example.com.", "example.com.", 300),
+			{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			},
+		},
+		Authorities: []dnsmessage.Resource{newSOAResource("example.com.")},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}},
+	}
+	// Pack compresses names, so the rewrite must follow compression pointers.
+	raw, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	got, err := rewriteRawResp(raw, 42, 50*time.Second)
+	if err != nil {
+		t.Fatalf("rewriteRawResp: %v", err)
+	}
+
+	resp := dnsmessage.Message{}
+	if err := resp.Unpack(got); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if resp.ID != 42 {
+		t.Errorf("ID: got %d; want 42", resp.ID)
+	}
+	// Every record has the remaining TTL of the answer.
+	wantTTLs := []uint32{50, 50, 50}
+	gotTTLs := []uint32{resp.Answers[0].Header.TTL, resp.Answers[1].Header.TTL, resp.Authorities[0].Header.TTL}
+	for i := range wantTTLs {
+		if gotTTLs[i] != wantTTLs[i] {
+			t.Errorf("TTLs: got %v; want %v", gotTTLs, wantTTLs)
+			break
+		}
+	}
+	if !resp.Additionals[0].Header.DNSSECAllowed() {
+		t.Errorf("want OPT record DO bit unchanged")
+	}
+
+	// Apart from the ID and TTLs, the response is byte-for-byte identical.
+	msg.ID = 42
+	msg.Answers[0].Header.TTL = 50
+	msg.Answers[1].Header.TTL = 50
+	msg.Authorities[0].Header.TTL = 50
+	want, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("rewritten response mismatch\nwant: %x\ngot:  %x", want, got)
+	}
+}
+
+func TestRewriteRawResp_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{name: "short header", raw: []byte{0, 1, 2}},
+		{name: "truncated question", raw: []byte{0, 1, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 3, 'w'}},
+		{name: "truncated record", raw: []byte{0, 1, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := rewriteRawResp(tt.raw, 1, time.Minute); err == nil {
+				t.Errorf("rewriteRawResp: want error; got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package dns
+
+import "sync/atomic"
+
+// Stats are counters of the queries answered by a Cache.
+type Stats struct {
+	// Hits is the number of queries answered from the cache, including
+	// queries answered by waiting for another query's upstream response.
+	Hits int64 `json:"hits"`
+	// Misses is the number of queries sent to the upstream DNS server.
+	Misses int64 `json:"misses"`
+	// Entries is the number of answers in the default, in-memory cache,
+	// including expired answers not yet removed. Zero if QuestionCache is set.
+	Entries int64 `json:"entries"`
+	// Evictions is the number of answers evicted from the default, in-memory
+	// cache to stay within MaxEntries. Zero if QuestionCache is set.
+	Evictions int64 `json:"evictions"`
+	// UpstreamErrors is the number of failures to dial, write to, or read from
+	// the upstream DNS server, and SERVFAIL responses from the server.
+	UpstreamErrors int64 `json:"upstream_errors"`
+	// CoalescedWaits is the number of queries that waited for an in-progress
+	// upstream query for the same question instead of sending their own.
+	CoalescedWaits int64 `json:"coalesced_waits"`
+	// StaleServes is the number of queries answered with a stale answer.
+	StaleServes int64 `json:"stale_serves"`
+	// RejectedResponses is the number of upstream responses not cached because
+	// they failed validation. Valid responses that aren't cached, like
+	// SERVFAIL responses, aren't counted.
+	RejectedResponses int64 `json:"rejected_responses"`
+}
+
+// Stats returns the counters of the Cache since it was created or since the
+// last call to ResetStats.
+func (c *Cache) Stats() Stats {
+	c.init()
+	s := Stats{
+		Hits:              c.stats.hits.Load(),
+		Misses:            c.stats.misses.Load(),
+		UpstreamErrors:    c.stats.upstreamErrors.Load(),
+		CoalescedWaits:    c.stats.coalescedWaits.Load(),
+		StaleServes:       c.stats.staleServes.Load(),
+		RejectedResponses: c.stats.rejected.Load(),
+	}
+	if qc, ok := c.QuestionCache.(*questionCache); ok {
+		s.Entries = int64(qc.len())
+		s.Evictions = qc.evictions.Load()
+	}
+	return s
+}
+
+// ResetStats sets the counters of the Cache to zero. Entries is unaffected
+// since it counts the answers currently in the cache.
+func (c *Cache) ResetStats() {
+	c.init()
+	c.stats.hits.Store(0)
+	c.stats.misses.Store(0)
+	c.stats.upstreamErrors.Store(0)
+	c.stats.coalescedWaits.Store(0)
+	c.stats.staleServes.Store(0)
+	c.stats.rejected.Store(0)
+	if qc, ok := c.QuestionCache.(*questionCache); ok {
+		qc.hits.Store(0)
+		qc.misses.Store(0)
+		qc.evictions.Store(0)
+	}
+}
+
+// cacheStats counts events across all conns of a Cache.
+type cacheStats struct {
+	hits           atomic.Int64
+	misses         atomic.Int64
+	upstreamErrors atomic.Int64
+	coalescedWaits atomic.Int64
+	staleServes    atomic.Int64
+	// rejected is the number of upstream responses not cached because they
+	// failed validation.
+	rejected atomic.Int64
+}
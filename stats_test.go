@@ -0,0 +1,56 @@
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCache_Stats(t *testing.T) {
+	host := "test-cache-stats.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+	handler := fakeDNS.handler
+	cache := &Cache{
+		Dial:       fakeDNS.DialContext,
+		MaxEntries: 1,
+		MaxStale:   time.Minute,
+	}
+	cache.init()
+	exchange := func(name string) {
+		t.Helper()
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+		if _, err := cache.exchange(t.Context(), "udp", "127.0.0.1:53", q); err != nil {
+			t.Fatalf("exchange %s: %v", name, err)
+		}
+	}
+
+	exchange(host)            // miss
+	exchange(host)            // hit
+	exchange("other." + host) // miss, evicts host
+	assertStats(t, cache, Stats{Hits: 1, Misses: 2, Entries: 1, Evictions: 1})
+
+	// Serve a stale answer when the upstream DNS server fails.
+	cache.QuestionCache.Set(
+		Question{FQDN: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Answer{FetchTime: time.Now().Add(-90 * time.Second), TTL: time.Minute, IPs: []netip.Addr{netip.MustParseAddr("10.0.0.1")}},
+	)
+	fakeDNS.handler = func(string, dnsmessage.Message) (dnsmessage.Message, error) {
+		return dnsmessage.Message{}, fmt.Errorf("upstream unavailable")
+	}
+	exchange(host)
+	fakeDNS.handler = handler
+	assertStats(t, cache, Stats{Hits: 1, Misses: 3, Entries: 1, Evictions: 2, UpstreamErrors: 1, StaleServes: 1})
+
+	cache.ResetStats()
+	assertStats(t, cache, Stats{Entries: 1})
+}
+
+func assertStats(t *testing.T, cache *Cache, want Stats) {
+	t.Helper()
+	if got := cache.Stats(); got != want {
+		t.Errorf("Stats mismatch\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
@@ -0,0 +1,221 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SVCB and HTTPS record types, per RFC 9460. The dnsmessage package parses
+// both as a dnsmessage.UnknownResource.
+const (
+	typeSVCB  dnsmessage.Type = 64
+	typeHTTPS dnsmessage.Type = 65
+)
+
+// SvcParamKeys, per RFC 9460 section 14.3.2.
+const (
+	svcParamMandatory     = 0
+	svcParamALPN          = 1
+	svcParamNoDefaultALPN = 2
+	svcParamPort          = 3
+	svcParamIPv4Hint      = 4
+	svcParamECH           = 5
+	svcParamIPv6Hint      = 6
+)
+
+// ServiceBinding is a parsed SVCB or HTTPS record, per RFC 9460.
+type ServiceBinding struct {
+	// Priority is the SvcPriority. Zero means AliasMode, where Target is an
+	// alias for the owner name. Otherwise, lower priorities are preferred.
+	Priority uint16
+	// Target is the TargetName with a trailing dot. In ServiceMode, "." means
+	// the owner name.
+	Target string
+	// ALPN are the supported protocol IDs, like "h2" or "h3".
+	ALPN []string
+	// NoDefaultALPN is true if the default protocol of the scheme, like
+	// "http/1.1" for HTTPS, is not supported.
+	NoDefaultALPN bool
+	// Port is the alternative port for the service. Zero if absent.
+	Port uint16
+	// IPv4Hint and IPv6Hint are addresses clients may use to reach Target.
+	IPv4Hint []netip.Addr
+	IPv6Hint []netip.Addr
+	// ECH is the ECHConfigList for TLS Encrypted Client Hello.
+	ECH []byte
+	// Mandatory are the SvcParamKeys a client must support to use the record.
+	Mandatory []uint16
+	// Params are SvcParams not parsed into other fields, keyed by SvcParamKey.
+	Params map[uint16][]byte
+}
+
+// LookupHTTPS returns the service bindings from the HTTPS records for host,
+// sorted by priority. Returns no service bindings and no error if host has no
+// HTTPS records. Answers are cached like other record types.
+//
+// Unlike the Go resolver, LookupHTTPS reads only the nameservers and the
+// timeout and attempts options from /etc/resolv.conf. The host is always
+// treated as fully qualified, so search domains and ndots are ignored, as
+// are other options, like rotate. Each query times out after the timeout
+// option, 5 seconds by default, even if ctx has no deadline.
+func (c *Cache) LookupHTTPS(ctx context.Context, host string) ([]ServiceBinding, error) {
+	return c.lookupServiceBindings(ctx, host, typeHTTPS)
+}
+
+// LookupSVCB returns the service bindings from the SVCB records for name,
+// sorted by priority. The name usually includes an attrleaf label, like
+// "_dns.resolver.arpa". Returns no service bindings and no error if name has
+// no SVCB records. Answers are cached like other record types. Queries the
+// nameservers from /etc/resolv.conf like LookupHTTPS.
+func (c *Cache) LookupSVCB(ctx context.Context, name string) ([]ServiceBinding, error) {
+	return c.lookupServiceBindings(ctx, name, typeSVCB)
+}
+
+func (c *Cache) lookupServiceBindings(ctx context.Context, name string, typ dnsmessage.Type) ([]ServiceBinding, error) {
+	msg, err := c.lookup(ctx, name, typ)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []ServiceBinding
+	for _, r := range msg.Answers {
+		if r.Header.Type != typ {
+			continue
+		}
+		res, ok := r.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s record body: %v", typ, r.Body)
+		}
+		b, err := parseServiceBinding(res.Data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s record for %s: %w", typ, name, err)
+		}
+		bindings = append(bindings, b)
+	}
+	slices.SortStableFunc(bindings, func(a, b ServiceBinding) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+	return bindings, nil
+}
+
+// parseServiceBinding parses the RDATA of an SVCB or HTTPS record, per RFC
+// 9460 section 2.2.
+func parseServiceBinding(data []byte) (ServiceBinding, error) {
+	if len(data) < 2 {
+		return ServiceBinding{}, fmt.Errorf("missing SvcPriority")
+	}
+	b := ServiceBinding{Priority: binary.BigEndian.Uint16(data)}
+	target, n, err := parseUncompressedName(data[2:])
+	if err != nil {
+		return ServiceBinding{}, fmt.Errorf("parse TargetName: %w", err)
+	}
+	b.Target = target
+
+	params := data[2+n:]
+	for len(params) > 0 {
+		if len(params) < 4 {
+			return ServiceBinding{}, fmt.Errorf("truncated SvcParam header")
+		}
+		key := binary.BigEndian.Uint16(params)
+		l := int(binary.BigEndian.Uint16(params[2:]))
+		if len(params) < 4+l {
+			return ServiceBinding{}, fmt.Errorf("SvcParam %d has length %d but only %d bytes", key, l, len(params)-4)
+		}
+		value := params[4 : 4+l]
+		params = params[4+l:]
+		if err := b.setParam(key, value); err != nil {
+			return ServiceBinding{}, fmt.Errorf("parse SvcParam %d: %w", key, err)
+		}
+	}
+	return b, nil
+}
+
+// setParam parses the SvcParam value for key into b.
+func (b *ServiceBinding) setParam(key uint16, value []byte) error {
+	switch key {
+	case svcParamMandatory:
+		if len(value)%2 != 0 {
+			return fmt.Errorf("mandatory length %d not a multiple of 2", len(value))
+		}
+		for i := 0; i < len(value); i += 2 {
+			b.Mandatory = append(b.Mandatory, binary.BigEndian.Uint16(value[i:]))
+		}
+	case svcParamALPN:
+		for len(value) > 0 {
+			l := int(value[0])
+			if l == 0 || len(value) < 1+l {
+				return fmt.Errorf("invalid alpn-id length %d", l)
+			}
+			b.ALPN = append(b.ALPN, string(value[1:1+l]))
+			value = value[1+l:]
+		}
+	case svcParamNoDefaultALPN:
+		if len(value) != 0 {
+			return fmt.Errorf("no-default-alpn must be empty")
+		}
+		b.NoDefaultALPN = true
+	case svcParamPort:
+		if len(value) != 2 {
+			return fmt.Errorf("port length %d, want 2", len(value))
+		}
+		b.Port = binary.BigEndian.Uint16(value)
+	case svcParamIPv4Hint:
+		if len(value) == 0 || len(value)%4 != 0 {
+			return fmt.Errorf("ipv4hint length %d not a multiple of 4", len(value))
+		}
+		for i := 0; i < len(value); i += 4 {
+			b.IPv4Hint = append(b.IPv4Hint, netip.AddrFrom4([4]byte(value[i:i+4])))
+		}
+	case svcParamECH:
+		b.ECH = slices.Clone(value)
+	case svcParamIPv6Hint:
+		if len(value) == 0 || len(value)%16 != 0 {
+			return fmt.Errorf("ipv6hint length %d not a multiple of 16", len(value))
+		}
+		for i := 0; i < len(value); i += 16 {
+			b.IPv6Hint = append(b.IPv6Hint, netip.AddrFrom16([16]byte(value[i:i+16])))
+		}
+	default:
+		if b.Params == nil {
+			b.Params = make(map[uint16][]byte)
+		}
+		b.Params[key] = slices.Clone(value)
+	}
+	return nil
+}
+
+// parseUncompressedName parses an uncompressed domain name in wire format, as
+// required for the SVCB TargetName. Returns the name with a trailing dot and
+// the number of bytes read.
+func parseUncompressedName(data []byte) (string, int, error) {
+	var sb strings.Builder
+	off := 0
+	for {
+		if off >= len(data) {
+			return "", 0, fmt.Errorf("name missing terminating root label")
+		}
+		l := int(data[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if l > 63 {
+			return "", 0, fmt.Errorf("invalid label length %d", l)
+		}
+		if off+l > len(data) {
+			return "", 0, fmt.Errorf("label length %d exceeds data", l)
+		}
+		sb.Write(data[off : off+l])
+		sb.WriteByte('.')
+		off += l
+	}
+	if sb.Len() == 0 {
+		return ".", off, nil
+	}
+	return sb.String(), off, nil
+}
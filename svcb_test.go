@@ -0,0 +1,208 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCache_LookupHTTPS(t *testing.T) {
+	host := "test-cache-https.example.com."
+	_, fakeDNS := startServers(t, strings.TrimSuffix(host, "."))
+	handler := fakeDNS.handler
+	upstreamQueries := new(atomic.Int64)
+	wantBindings := []ServiceBinding{
+		{Priority: 0, Target: "alias.example.net."},
+		{
+			Priority: 1,
+			Target:   ".",
+			ALPN:     []string{"h3", "h2"},
+			Port:     8443,
+			IPv4Hint: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+			IPv6Hint: []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+			ECH:      []byte{0xfe, 0x0d},
+		},
+	}
+	fakeDNS.handler = func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		if len(q.Questions) != 1 || q.Questions[0].Type != typeHTTPS {
+			return handler(network, q)
+		}
+		r := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+		}
+		// Reverse the order to check sorting by priority.
+		for i := len(wantBindings) - 1; i >= 0; i-- {
+			r.Answers = append(r.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{
+					Name:  q.Questions[0].Name,
+					Type:  typeHTTPS,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.UnknownResource{
+					Type: typeHTTPS,
+					Data: packServiceBinding(wantBindings[i]),
+				},
+			})
+		}
+		return r, nil
+	}
+
+	cache := &Cache{
+		Dial: fakeDNS.DialContext,
+	}
+	for range 2 {
+		got, err := cache.LookupHTTPS(t.Context(), host)
+		if err != nil {
+			t.Fatalf("LookupHTTPS: %v", err)
+		}
+		if !reflect.DeepEqual(got, wantBindings) {
+			t.Errorf("LookupHTTPS mismatch\nwant: %+v\ngot:  %+v", wantBindings, got)
+		}
+	}
+	// The second lookup should use the cache.
+	if got := upstreamQueries.Load(); got != 1 {
+		t.Errorf("upstream queries: got %d; want 1", got)
+	}
+
+	// NXDOMAIN returns a not found error.
+	_, err := cache.LookupSVCB(t.Context(), "_dns."+host)
+	assertNotFound(t, err)
+
+	// NODATA returns no service bindings and no error.
+	got, err := cache.LookupSVCB(t.Context(), host)
+	if err != nil || len(got) != 0 {
+		t.Errorf("LookupSVCB: got %v, %v; want no bindings and no error", got, err)
+	}
+}
+
+func TestCache_LookupHTTPSCaseRandomization(t *testing.T) {
+	host := "test-cache-https-case.example.com."
+	_, fakeDNS := startServers(t, strings.TrimSuffix(host, "."))
+	upstreamQueries := new(atomic.Int64)
+	want := []ServiceBinding{{Priority: 1, Target: ".", ALPN: []string{"h2"}}}
+	// The upstream DNS server lowercases the question name, so the cache
+	// rejects the response, but the lookup still uses it.
+	fakeDNS.handler = func(_ string, q dnsmessage.Message) (dnsmessage.Message, error) {
+		upstreamQueries.Add(1)
+		name := dnsmessage.MustNewName(strings.ToLower(q.Questions[0].Name.String()))
+		return dnsmessage.Message{
+			Header: dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+			Questions: []dnsmessage.Question{{
+				Name:  name,
+				Type:  q.Questions[0].Type,
+				Class: q.Questions[0].Class,
+			}},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: typeHTTPS, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.UnknownResource{Type: typeHTTPS, Data: packServiceBinding(want[0])},
+			}},
+		}, nil
+	}
+
+	cache := &Cache{
+		Dial:              fakeDNS.DialContext,
+		CaseRandomization: true,
+	}
+	for range 2 {
+		got, err := cache.LookupHTTPS(t.Context(), host)
+		if err != nil {
+			t.Fatalf("LookupHTTPS: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupHTTPS mismatch\nwant: %+v\ngot:  %+v", want, got)
+		}
+	}
+	// Neither response is cached.
+	if got := upstreamQueries.Load(); got != 2 {
+		t.Errorf("upstream queries: got %d; want 2", got)
+	}
+	if got := cache.Stats().RejectedResponses; got != 2 {
+		t.Errorf("rejected responses: got %d; want 2", got)
+	}
+}
+
+func TestParseServiceBinding_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "missing target", data: []byte{0, 1}},
+		{name: "truncated target", data: []byte{0, 1, 3, 'f', 'o'}},
+		{name: "truncated param header", data: []byte{0, 1, 0, 0, 1}},
+		{name: "truncated param value", data: []byte{0, 1, 0, 0, 3, 0, 2, 1}},
+		{name: "invalid port", data: []byte{0, 1, 0, 0, 3, 0, 1, 1}},
+		{name: "invalid ipv4hint", data: []byte{0, 1, 0, 0, 4, 0, 3, 1, 2, 3}},
+		{name: "empty alpn-id", data: []byte{0, 1, 0, 0, 1, 0, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if b, err := parseServiceBinding(tt.data); err == nil {
+				t.Errorf("parseServiceBinding: want error; got %+v", b)
+			}
+		})
+	}
+}
+
+// packServiceBinding returns the RDATA of an SVCB or HTTPS record for b.
+func packServiceBinding(b ServiceBinding) []byte {
+	data := binary.BigEndian.AppendUint16(nil, b.Priority)
+	for _, label := range strings.Split(strings.TrimSuffix(b.Target, "."), ".") {
+		if label == "" {
+			continue
+		}
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	data = append(data, 0)
+
+	appendParam := func(key uint16, value []byte) {
+		data = binary.BigEndian.AppendUint16(data, key)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+		data = append(data, value...)
+	}
+	if len(b.ALPN) > 0 {
+		var value []byte
+		for _, id := range b.ALPN {
+			value = append(value, byte(len(id)))
+			value = append(value, id...)
+		}
+		appendParam(svcParamALPN, value)
+	}
+	if b.NoDefaultALPN {
+		appendParam(svcParamNoDefaultALPN, nil)
+	}
+	if b.Port != 0 {
+		appendParam(svcParamPort, binary.BigEndian.AppendUint16(nil, b.Port))
+	}
+	if len(b.IPv4Hint) > 0 {
+		var value []byte
+		for _, ip := range b.IPv4Hint {
+			value = append(value, ip.AsSlice()...)
+		}
+		appendParam(svcParamIPv4Hint, value)
+	}
+	if len(b.ECH) > 0 {
+		appendParam(svcParamECH, b.ECH)
+	}
+	if len(b.IPv6Hint) > 0 {
+		var value []byte
+		for _, ip := range b.IPv6Hint {
+			value = append(value, ip.AsSlice()...)
+		}
+		appendParam(svcParamIPv6Hint, value)
+	}
+	if len(b.Params) > 0 {
+		panic(fmt.Sprintf("packServiceBinding: unsupported params %v", b.Params))
+	}
+	return data
+}
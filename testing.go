@@ -11,6 +11,7 @@ import (
 	"net/http/httptrace"
 	"net/netip"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -125,38 +126,101 @@ func startDNSServer(t *testing.T, fqdnHost string, ip netip.Addr) *dnsServer {
 		handler: func(network string, q dnsmessage.Message) (dnsmessage.Message, error) {
 			r := dnsmessage.Message{
 				Header: dnsmessage.Header{
-					ID:       q.Header.ID,
-					Response: true,
-					RCode:    dnsmessage.RCodeSuccess,
+					ID:                 q.Header.ID,
+					Response:           true,
+					RecursionAvailable: true,
+					RCode:              dnsmessage.RCodeSuccess,
 				},
 				Questions: q.Questions,
 			}
 			fqdn := dnsmessage.MustNewName(fqdnHost)
-			if len(q.Questions) == 1 &&
-				q.Questions[0].Type == dnsmessage.TypeA &&
-				q.Questions[0].Class == dnsmessage.ClassINET &&
-				fqdn == q.Questions[0].Name {
-				r.Answers = []dnsmessage.Resource{
-					{
-						Header: dnsmessage.ResourceHeader{
-							Name:   q.Questions[0].Name,
-							Type:   dnsmessage.TypeA,
-							Class:  dnsmessage.ClassINET,
-							Length: 4,
-						},
-						Body: &dnsmessage.AResource{
-							A: ip.As4(),
-						},
+			if len(q.Questions) != 1 || q.Questions[0].Class != dnsmessage.ClassINET {
+				return r, nil
+			}
+			// Negative responses include an SOA record per RFC 2308.
+			if !strings.EqualFold(fqdn.String(), q.Questions[0].Name.String()) {
+				r.RCode = dnsmessage.RCodeNameError
+				r.Authorities = []dnsmessage.Resource{newSOAResource(fqdnHost)}
+				return r, nil
+			}
+			if q.Questions[0].Type != dnsmessage.TypeA {
+				r.Authorities = []dnsmessage.Resource{newSOAResource(fqdnHost)}
+				return r, nil
+			}
+			r.Answers = []dnsmessage.Resource{
+				{
+					Header: dnsmessage.ResourceHeader{
+						Name:   q.Questions[0].Name,
+						Type:   dnsmessage.TypeA,
+						Class:  dnsmessage.ClassINET,
+						TTL:    60,
+						Length: 4,
 					},
-				}
+					Body: &dnsmessage.AResource{
+						A: ip.As4(),
+					},
+				},
 			}
-
 			return r, nil
 		},
 	}
 	return fakeDNS
 }
 
+// newSOAResource returns an SOA record for the zone of fqdnHost with a
+// negative caching TTL of 30 seconds.
+func newSOAResource(fqdnHost string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(fqdnHost),
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		},
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("ns." + fqdnHost),
+			MBox:    dnsmessage.MustNewName("hostmaster." + fqdnHost),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  30,
+		},
+	}
+}
+
+// newCNAMEResource returns a CNAME record from name to target.
+func newCNAMEResource(name, target string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeCNAME,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+// newDNAMEResource returns a DNAME record from name to target, per RFC 6672.
+func newDNAMEResource(name, target string) dnsmessage.Resource {
+	var data []byte
+	for _, label := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	data = append(data, 0)
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typeDNAME,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		},
+		Body: &dnsmessage.UnknownResource{Type: typeDNAME, Data: data},
+	}
+}
+
 type dnsServer struct {
 	t       *testing.T
 	handler func(network string, q dnsmessage.Message) (dnsmessage.Message, error)
@@ -164,7 +228,7 @@ type dnsServer struct {
 
 func (s *dnsServer) DialContext(_ context.Context, network, _ string) (net.Conn, error) {
 	s.t.Logf("dial fake dns server network %s", network) // addr is ignored
-	return &fakeDNSConn{server: s, network: network}, nil
+	return &fakeDNSConn{server: s, network: network, tcp: strings.HasPrefix(network, "tcp")}, nil
 }
 
 type fakeDNSConn struct {
@@ -221,8 +285,10 @@ func (f *fakeDNSConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
-func (f *fakeDNSConn) Close() error                { return nil }
-func (f *fakeDNSConn) SetDeadline(time.Time) error { return nil }
+func (f *fakeDNSConn) Close() error                     { return nil }
+func (f *fakeDNSConn) SetDeadline(time.Time) error      { return nil }
+func (f *fakeDNSConn) SetReadDeadline(time.Time) error  { return nil }
+func (f *fakeDNSConn) SetWriteDeadline(time.Time) error { return nil }
 
 func cmpNetIP(a, b netip.Addr) int { return a.Compare(b) }
 
@@ -233,4 +299,7 @@ func assertSameAddrs(t *testing.T, want []netip.Addr, got []netip.Addr) {
 	if len(want) != len(got) {
 		t.Fatalf("want %d addresses, got %d\nwant: %v\ngot:  %v", len(want), len(got), want, got)
 	}
+	if !slices.Equal(want, got) {
+		t.Fatalf("addresses mismatch\nwant: %v\ngot:  %v", want, got)
+	}
 }
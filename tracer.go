@@ -0,0 +1,78 @@
+package dns
+
+import "context"
+
+// Span attribute keys set by Cache.
+const (
+	// AttrQuestion is the question name, like "example.com.".
+	AttrQuestion = "dns.question.name"
+	// AttrType is the question type, like "A". See TypeLabel.
+	AttrType = "dns.question.type"
+	// AttrCacheResult is how the query was answered: "hit", "coalesced" for
+	// an answer from another query's upstream response, "miss", "stale", or
+	// "passthrough" for uncacheable queries sent upstream.
+	AttrCacheResult = "dns.cache.result"
+	// AttrUpstream is the address of the upstream DNS server.
+	AttrUpstream = "dns.upstream.address"
+	// AttrRCode is the response code, like "RCodeSuccess".
+	AttrRCode = "dns.response.rcode"
+)
+
+// Tracer starts spans for queries answered by a Cache. Each span starts when
+// the resolver writes a query and ends when the resolver closes the conn, so
+// it includes any upstream round trip.
+//
+// Tracer is typically an adapter for an OpenTelemetry tracer, like:
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, dns.Span) {
+//		ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ span trace.Span }
+//
+//	func (s otelSpan) SetAttribute(key, value string) {
+//		s.span.SetAttributes(attribute.String(key, value))
+//	}
+//
+//	func (s otelSpan) RecordError(err error) {
+//		s.span.RecordError(err)
+//		s.span.SetStatus(codes.Error, err.Error())
+//	}
+//
+//	func (s otelSpan) End() { s.span.End() }
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, if any.
+	// The ctx is from the resolver's dial, so it carries the span of the
+	// lookup, like the span of an HTTP request. Returns a context with the new
+	// span, used to dial the upstream DNS server.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer. Methods are only called by the
+// goroutine that started the span.
+type Span interface {
+	// SetAttribute sets the attribute key to value. See the Attr constants
+	// for keys.
+	SetAttribute(key, value string)
+	// RecordError records a failed query to the upstream DNS server.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// nopTracer is a Tracer that starts spans that do nothing.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+// nopSpan is a Span that does nothing.
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, string) {}
+func (nopSpan) RecordError(error)           {}
+func (nopSpan) End()                        {}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCache_Tracer(t *testing.T) {
+	host := "test-cache-tracer.example.com."
+	fakeDNS := startDNSServer(t, host, netip.MustParseAddr("10.0.0.1"))
+	tracer := &recordingTracer{}
+	cache := &Cache{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if ctx.Value(spanKey{}) == nil {
+				t.Errorf("dial context missing span")
+			}
+			return fakeDNS.DialContext(ctx, network, addr)
+		},
+		Tracer: tracer,
+	}
+	cache.init()
+
+	type parentKey struct{}
+	ctx := context.WithValue(t.Context(), parentKey{}, "parent")
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(host), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	for range 2 {
+		if _, err := cache.exchange(ctx, "udp", "127.0.0.1:53", q); err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+	}
+
+	spans := tracer.ended()
+	if len(spans) != 2 {
+		t.Fatalf("want 2 ended spans; got %d", len(spans))
+	}
+	for i, result := range []string{"miss", "hit"} {
+		want := map[string]string{
+			AttrQuestion:    host,
+			AttrType:        "A",
+			AttrCacheResult: result,
+			AttrUpstream:    "127.0.0.1:53",
+			AttrRCode:       "RCodeSuccess",
+		}
+		if got := spans[i].attrs; !maps.Equal(got, want) {
+			t.Errorf("span %d attributes mismatch\nwant: %v\ngot:  %v", i, want, got)
+		}
+		if spans[i].parent.Value(parentKey{}) != "parent" {
+			t.Errorf("span %d: want parent context from dial", i)
+		}
+	}
+
+	// Upstream failures are recorded as errors.
+	fakeDNS.handler = func(string, dnsmessage.Message) (dnsmessage.Message, error) {
+		return dnsmessage.Message{}, fmt.Errorf("upstream unavailable")
+	}
+	q.Type = dnsmessage.TypeAAAA
+	if _, err := cache.exchange(ctx, "udp", "127.0.0.1:53", q); err == nil {
+		t.Fatalf("exchange: want error")
+	}
+	spans = tracer.ended()
+	if got := spans[len(spans)-1]; len(got.errs) != 1 || got.attrs[AttrCacheResult] != "miss" {
+		t.Errorf("want miss span with 1 error; got attributes %v and errors %v", got.attrs, got.errs)
+	}
+}
+
+type spanKey struct{}
+
+// recordingTracer is a Tracer that records ended spans.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	span := &recordingSpan{tracer: t, parent: ctx, attrs: make(map[string]string)}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *recordingTracer) ended() []*recordingSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.spans
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	parent context.Context
+	attrs  map[string]string
+	errs   []error
+}
+
+func (s *recordingSpan) SetAttribute(key, value string) { s.attrs[key] = value }
+func (s *recordingSpan) RecordError(err error)          { s.errs = append(s.errs, err) }
+
+func (s *recordingSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s)
+}